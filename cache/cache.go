@@ -0,0 +1,472 @@
+// Package cache implements an on-disk cache for files served by refractor, which evicts the least recently used files
+// once it grows over its maximum size.
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tmpPrefix is prepended to the name of files still being written to the cache.
+const tmpPrefix = ".tmp-"
+
+// DefaultRules are used when none are configured. Archlinux packages never change once published, so they can be kept
+// until evicted, while databases must always be fetched from mirrors.
+var DefaultRules = []Rule{
+	{Suffix: ".pkg.tar.zst"},
+	{Suffix: ".pkg.tar.xz"},
+}
+
+// Profiles contains the rules used when none are configured for each of the supported distributions. Packages are
+// immutable on all of them, as is metadata served under by-hash paths on Debian. Other metadata, like InRelease or
+// repomd.xml, is never cached.
+var Profiles = map[string][]Rule{
+	"archlinux": DefaultRules,
+	"debian": {
+		{Suffix: ".deb"},
+		{Regex: `/by-hash/`},
+	},
+	"fedora": {
+		{Suffix: ".rpm"},
+	},
+}
+
+// Rule matches request paths either by suffix or by regular expression, and defines for how long they are cached.
+type Rule struct {
+	// Suffix matches paths ending with the given string.
+	Suffix string `yaml:"suffix,omitempty"`
+	// Regex matches paths against a regular expression.
+	Regex string `yaml:"regex,omitempty"`
+
+	// TTL is the time after which a cached file is considered stale and downloaded again. Zero keeps files until they
+	// are evicted, and a negative value prevents matching paths from being cached at all.
+	TTL time.Duration `yaml:"ttl,omitempty"`
+	// Revalidate makes expired files be revalidated with mirrors, using the ETag and Last-Modified headers they were
+	// served with, rather than downloaded again. With a TTL of zero, files are revalidated every time they are
+	// requested, which makes caching safe for paths whose contents change.
+	Revalidate bool `yaml:"revalidate,omitempty"`
+
+	regex *regexp.Regexp
+}
+
+func (r *Rule) matches(path string) bool {
+	if r.Suffix != "" && !strings.HasSuffix(path, r.Suffix) {
+		return false
+	}
+
+	if r.regex != nil && !r.regex.MatchString(path) {
+		return false
+	}
+
+	return true
+}
+
+// expired returns whether the cached file e is no longer fresh according to the rule. With a TTL of zero, files never
+// expire unless they have to be revalidated, in which case they always do.
+func (r *Rule) expired(e *entry) bool {
+	if r.TTL == 0 {
+		return r.Revalidate
+	}
+
+	return time.Since(e.stored) > r.TTL
+}
+
+func (r *Rule) compile() error {
+	if r.Suffix == "" && r.Regex == "" {
+		return fmt.Errorf("rule must define either suffix or regex")
+	}
+
+	if r.Regex != "" {
+		var err error
+		r.regex, err = regexp.Compile(r.Regex)
+		if err != nil {
+			return fmt.Errorf("compiling regex: %w", err)
+		}
+	}
+
+	return nil
+}
+
+type Config struct {
+	// Dir is the directory where cached files are stored. Caching is disabled if it is empty.
+	Dir string `yaml:"dir"`
+	// MaxSizeMiBs is the maximum size of all cached files put together. Least recently used files are removed from
+	// the cache to stay under it.
+	MaxSizeMiBs int64 `yaml:"maxSizeMiBs"`
+	// Rules define which paths are cached, and for how long. The first rule matching a path applies to it, and paths
+	// not matched by any rule are not cached. Defaults to DefaultRules.
+	Rules []Rule `yaml:"rules"`
+	// ServeStale keeps files after their TTL expires, until they are evicted, so a stale copy can be served if every
+	// mirror fails to serve a fresh one. By default, expired files are removed as soon as they are requested.
+	ServeStale bool `yaml:"serveStale"`
+}
+
+type entry struct {
+	size   int64
+	stored time.Time
+	used   time.Time
+	// etag and lastModified are the validators the file was served with, if any. They are not persisted, so files
+	// left over from a previous run cannot be revalidated.
+	etag         string
+	lastModified string
+}
+
+// revalidatable returns whether the file has validators to revalidate it with.
+func (e *entry) revalidatable() bool {
+	return e.etag != "" || e.lastModified != ""
+}
+
+type Cache struct {
+	dir        string
+	maxBytes   int64
+	rules      []Rule
+	serveStale bool
+
+	mtx     sync.Mutex
+	entries map[string]*entry // Keyed by file name.
+	size    int64
+}
+
+// New creates a cache storing files in config.Dir, creating it if needed. Files left over from a previous run are
+// kept, while partially written ones are removed.
+func New(config Config) (*Cache, error) {
+	if config.MaxSizeMiBs <= 0 {
+		return nil, fmt.Errorf("maxSizeMiBs must be positive")
+	}
+
+	if config.Rules == nil {
+		config.Rules = DefaultRules
+	}
+
+	rules := make([]Rule, len(config.Rules))
+	copy(rules, config.Rules)
+	for i := range rules {
+		err := rules[i].compile()
+		if err != nil {
+			return nil, fmt.Errorf("rule #%d: %w", i, err)
+		}
+	}
+
+	err := os.MkdirAll(config.Dir, 0o755)
+	if err != nil {
+		return nil, fmt.Errorf("creating cache dir: %w", err)
+	}
+
+	c := &Cache{
+		dir:        config.Dir,
+		maxBytes:   config.MaxSizeMiBs * 1024 * 1024,
+		rules:      rules,
+		serveStale: config.ServeStale,
+		entries:    map[string]*entry{},
+	}
+
+	err = c.load()
+	if err != nil {
+		return nil, fmt.Errorf("loading cache dir: %w", err)
+	}
+
+	return c, nil
+}
+
+// load indexes the files already in the cache directory. As the time files were last used is not persisted, they are
+// considered used when they were stored.
+func (c *Cache) load() error {
+	dirEntries, err := os.ReadDir(c.dir)
+	if err != nil {
+		return err
+	}
+
+	for _, de := range dirEntries {
+		if de.IsDir() {
+			continue
+		}
+
+		if strings.HasPrefix(de.Name(), tmpPrefix) {
+			_ = os.Remove(filepath.Join(c.dir, de.Name()))
+			continue
+		}
+
+		info, err := de.Info()
+		if err != nil {
+			return err
+		}
+
+		c.entries[de.Name()] = &entry{size: info.Size(), stored: info.ModTime(), used: info.ModTime()}
+		c.size += info.Size()
+	}
+
+	// The cache may have been left over a smaller maximum size. The mutex is not needed yet, as the cache is not
+	// shared until New returns.
+	c.evict()
+
+	return nil
+}
+
+// rule returns the first rule matching path, or nil if path should not be cached.
+func (c *Cache) rule(path string) *Rule {
+	for i := range c.rules {
+		if c.rules[i].matches(path) {
+			if c.rules[i].TTL < 0 {
+				return nil
+			}
+			return &c.rules[i]
+		}
+	}
+
+	return nil
+}
+
+// Cacheable returns whether path would be stored in the cache.
+func (c *Cache) Cacheable(path string) bool {
+	return c.rule(path) != nil
+}
+
+// Get returns an open file with the cached contents of path, and the time it was stored. It returns false if path is
+// not cached, or if it has expired. The caller must close the file.
+func (c *Cache) Get(path string) (io.ReadSeekCloser, time.Time, bool) {
+	return c.get(path, false)
+}
+
+// GetStale returns the cached contents of path as Get does, even if they have expired. It returns false if path is not
+// cached, or if the cache does not keep stale files.
+func (c *Cache) GetStale(path string) (io.ReadSeekCloser, time.Time, bool) {
+	if !c.serveStale {
+		return nil, time.Time{}, false
+	}
+
+	return c.get(path, true)
+}
+
+func (c *Cache) get(path string, stale bool) (io.ReadSeekCloser, time.Time, bool) {
+	rule := c.rule(path)
+	if rule == nil {
+		return nil, time.Time{}, false
+	}
+
+	name := fileName(path)
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	e := c.entries[name]
+	if e == nil {
+		return nil, time.Time{}, false
+	}
+
+	if !stale && rule.expired(e) {
+		// Stale files are kept, if requested, until a fresh copy replaces them or they are evicted, and so are those
+		// that can be revalidated.
+		if !c.serveStale && !(rule.Revalidate && e.revalidatable()) {
+			c.remove(name)
+		}
+		return nil, time.Time{}, false
+	}
+
+	return c.open(name, e)
+}
+
+// open returns an open file with the contents of the cached entry e, named name, and marks it as used. It must be
+// called with the mutex held.
+func (c *Cache) open(name string, e *entry) (io.ReadSeekCloser, time.Time, bool) {
+	// The file remains readable while open, even if it is evicted while being sent.
+	file, err := os.Open(filepath.Join(c.dir, name))
+	if err != nil {
+		c.remove(name)
+		return nil, time.Time{}, false
+	}
+
+	e.used = time.Now()
+	return file, e.stored, true
+}
+
+// Validators returns the ETag and Last-Modified headers that the cached copy of path was served with, if it has
+// expired and should be revalidated with mirrors rather than downloaded again. Either of them may be empty. It returns
+// false if path is not cached, has not expired, or has no validators.
+func (c *Cache) Validators(path string) (string, string, bool) {
+	rule := c.rule(path)
+	if rule == nil || !rule.Revalidate {
+		return "", "", false
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	e := c.entries[fileName(path)]
+	if e == nil || !e.revalidatable() || !rule.expired(e) {
+		return "", "", false
+	}
+
+	return e.etag, e.lastModified, true
+}
+
+// Refresh marks the cached copy of path as fresh again, after a mirror reported that it did not change, and returns
+// it as Get does. It returns false if path is no longer cached.
+func (c *Cache) Refresh(path string) (io.ReadSeekCloser, time.Time, bool) {
+	name := fileName(path)
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	e := c.entries[name]
+	if e == nil {
+		return nil, time.Time{}, false
+	}
+
+	e.stored = time.Now()
+	return c.open(name, e)
+}
+
+// Create returns a Writer that stores path in the cache once committed.
+func (c *Cache) Create(path string) (Entry, error) {
+	file, err := os.CreateTemp(c.dir, tmpPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("creating cache file: %w", err)
+	}
+
+	return &Writer{cache: c, name: fileName(path), file: file}, nil
+}
+
+// Size returns the total size, in bytes, of the files in the cache.
+func (c *Cache) Size() int64 {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	return c.size
+}
+
+func (c *Cache) add(name string, size int64, etag, lastModified string) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if old := c.entries[name]; old != nil {
+		c.size -= old.size
+	}
+
+	now := time.Now()
+	c.entries[name] = &entry{size: size, stored: now, used: now, etag: etag, lastModified: lastModified}
+	c.size += size
+	c.evict()
+}
+
+// evict removes the least recently used files until the cache is under its maximum size. It must be called with the
+// mutex held.
+func (c *Cache) evict() {
+	for c.size > c.maxBytes {
+		var oldest string
+		for name, e := range c.entries {
+			if oldest == "" || e.used.Before(c.entries[oldest].used) {
+				oldest = name
+			}
+		}
+
+		if oldest == "" {
+			return
+		}
+
+		c.remove(oldest)
+	}
+}
+
+// remove deletes a file from the cache. It must be called with the mutex held.
+func (c *Cache) remove(name string) {
+	e := c.entries[name]
+	if e == nil {
+		return
+	}
+
+	_ = os.Remove(filepath.Join(c.dir, name))
+	delete(c.entries, name)
+	c.size -= e.size
+}
+
+// fileName returns the name of the file path is stored in, which is safe to use regardless of what path contains.
+func fileName(path string) string {
+	sum := sha256.Sum256([]byte(path))
+	return hex.EncodeToString(sum[:])
+}
+
+// Entry is a file being written to a cache. Nothing is stored until it is committed, so partially written files are
+// never served.
+type Entry interface {
+	io.Writer
+	// Size returns the amount of bytes written so far.
+	Size() int64
+	// SetValidators records the ETag and Last-Modified headers the file was served with, either of which may be
+	// empty, so it can be revalidated once expired. It must be called before Commit.
+	SetValidators(etag, lastModified string)
+	// Commit stores the file written so far, replacing any previous version of it.
+	Commit() error
+	// Discard drops the file written so far. It does nothing if the file was already committed.
+	Discard()
+}
+
+// Writer is the Entry of a Cache. It writes a file to a temporary location, and moves it into the cache once
+// committed.
+type Writer struct {
+	cache *Cache
+	name  string
+	file  *os.File
+	size  int64
+	done  bool
+
+	etag         string
+	lastModified string
+}
+
+func (w *Writer) Write(b []byte) (int, error) {
+	n, err := w.file.Write(b)
+	w.size += int64(n)
+	return n, err
+}
+
+// Size returns the amount of bytes written so far.
+func (w *Writer) Size() int64 {
+	return w.size
+}
+
+// SetValidators records the validators the file was served with, so it can be revalidated once expired.
+func (w *Writer) SetValidators(etag, lastModified string) {
+	w.etag, w.lastModified = etag, lastModified
+}
+
+// Commit adds the file written so far to the cache, replacing any previous version of it.
+func (w *Writer) Commit() error {
+	if w.done {
+		return fmt.Errorf("cache file already committed or discarded")
+	}
+	w.done = true
+
+	err := w.file.Close()
+	if err != nil {
+		_ = os.Remove(w.file.Name())
+		return fmt.Errorf("closing cache file: %w", err)
+	}
+
+	err = os.Rename(w.file.Name(), filepath.Join(w.cache.dir, w.name))
+	if err != nil {
+		_ = os.Remove(w.file.Name())
+		return fmt.Errorf("moving cache file into place: %w", err)
+	}
+
+	w.cache.add(w.name, w.size, w.etag, w.lastModified)
+	return nil
+}
+
+// Discard removes the file written so far. It does nothing if the file was already committed.
+func (w *Writer) Discard() {
+	if w.done {
+		return
+	}
+	w.done = true
+
+	_ = w.file.Close()
+	_ = os.Remove(w.file.Name())
+}
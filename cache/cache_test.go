@@ -0,0 +1,343 @@
+package cache_test
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"roob.re/refractor/cache"
+	"testing"
+	"time"
+)
+
+func store(t *testing.T, c *cache.Cache, path string, contents []byte) {
+	t.Helper()
+
+	w, err := c.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = w.Write(contents)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = w.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func cached(c *cache.Cache, path string) bool {
+	file, _, hit := c.Get(path)
+	if hit {
+		_ = file.Close()
+	}
+
+	return hit
+}
+
+func TestCache_Stores_Files(t *testing.T) {
+	t.Parallel()
+
+	c, err := cache.New(cache.Config{Dir: t.TempDir(), MaxSizeMiBs: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store(t, c, "/core/os/x86_64/linux-6.0.pkg.tar.zst", []byte("package"))
+
+	file, _, hit := c.Get("/core/os/x86_64/linux-6.0.pkg.tar.zst")
+	if !hit {
+		t.Fatalf("expected file to be cached")
+	}
+	defer file.Close()
+
+	contents, err := io.ReadAll(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(contents) != "package" {
+		t.Fatalf("expected cached contents to be %q, got %q", "package", contents)
+	}
+}
+
+func TestCache_Discards_Files(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	c, err := cache.New(cache.Config{Dir: dir, MaxSizeMiBs: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := c.Create("/core/os/x86_64/linux-6.0.pkg.tar.zst")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _ = w.Write([]byte("partial"))
+	w.Discard()
+
+	if cached(c, "/core/os/x86_64/linux-6.0.pkg.tar.zst") {
+		t.Fatalf("expected discarded file not to be cached")
+	}
+
+	files, _ := os.ReadDir(dir)
+	if len(files) != 0 {
+		t.Fatalf("expected cache dir to be empty, found %d files", len(files))
+	}
+}
+
+func TestCache_Applies_Rules(t *testing.T) {
+	t.Parallel()
+
+	c, err := cache.New(cache.Config{
+		Dir:         t.TempDir(),
+		MaxSizeMiBs: 1,
+		Rules: []cache.Rule{
+			{Suffix: ".db", TTL: -1},
+			{Suffix: ".files", TTL: time.Nanosecond},
+			{Regex: `^/core/`},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		path   string
+		cached bool
+	}{
+		{path: "/core/os/x86_64/core.db"},
+		{path: "/core/os/x86_64/core.files"},
+		{path: "/core/os/x86_64/linux-6.0.pkg.tar.zst", cached: true},
+		{path: "/extra/os/x86_64/firefox-106.0.pkg.tar.zst"},
+	} {
+		tc := tc
+		t.Run(tc.path, func(t *testing.T) {
+			t.Parallel()
+
+			store(t, c, tc.path, []byte(tc.path))
+			time.Sleep(time.Millisecond)
+
+			if hit := cached(c, tc.path); hit != tc.cached {
+				t.Fatalf("expected cached to be %v, got %v", tc.cached, hit)
+			}
+		})
+	}
+}
+
+func TestCache_Profiles(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		profile string
+		path    string
+		cached  bool
+	}{
+		{profile: "archlinux", path: "/core/os/x86_64/linux-6.0.pkg.tar.zst", cached: true},
+		{profile: "archlinux", path: "/core/os/x86_64/core.db"},
+		{profile: "debian", path: "/debian/pool/main/c/curl/curl_7.88.1-10_amd64.deb", cached: true},
+		{profile: "debian", path: "/debian/dists/bookworm/main/binary-amd64/by-hash/SHA256/0123abcd", cached: true},
+		{profile: "debian", path: "/debian/dists/bookworm/InRelease"},
+		{profile: "fedora", path: "/fedora/linux/releases/38/Everything/x86_64/os/Packages/c/curl-8.0.1-1.fc38.x86_64.rpm", cached: true},
+		{profile: "fedora", path: "/fedora/linux/releases/38/Everything/x86_64/os/repodata/repomd.xml"},
+	} {
+		tc := tc
+		t.Run(tc.profile+tc.path, func(t *testing.T) {
+			t.Parallel()
+
+			c, err := cache.New(cache.Config{Dir: t.TempDir(), MaxSizeMiBs: 1, Rules: cache.Profiles[tc.profile]})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if cacheable := c.Cacheable(tc.path); cacheable != tc.cached {
+				t.Fatalf("expected cacheable to be %v, got %v", tc.cached, cacheable)
+			}
+		})
+	}
+}
+
+func TestCache_Evicts_Least_Recently_Used(t *testing.T) {
+	t.Parallel()
+
+	c, err := cache.New(cache.Config{Dir: t.TempDir(), MaxSizeMiBs: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	half := make([]byte, 512*1024)
+	store(t, c, "/old.pkg.tar.zst", half)
+	time.Sleep(time.Millisecond)
+	store(t, c, "/used.pkg.tar.zst", half)
+	time.Sleep(time.Millisecond)
+
+	// Using the oldest file makes the other one the least recently used.
+	if !cached(c, "/old.pkg.tar.zst") {
+		t.Fatalf("expected file to be cached")
+	}
+	time.Sleep(time.Millisecond)
+
+	store(t, c, "/new.pkg.tar.zst", half)
+
+	if !cached(c, "/old.pkg.tar.zst") || !cached(c, "/new.pkg.tar.zst") {
+		t.Fatalf("expected recently used files to be kept")
+	}
+
+	if cached(c, "/used.pkg.tar.zst") {
+		t.Fatalf("expected least recently used file to be evicted")
+	}
+
+	if size := c.Size(); size != 2*int64(len(half)) {
+		t.Fatalf("expected cache size to be %d, got %d", 2*len(half), size)
+	}
+}
+
+func TestCache_Loads_Existing_Files(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	c, err := cache.New(cache.Config{Dir: dir, MaxSizeMiBs: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store(t, c, "/core/os/x86_64/linux-6.0.pkg.tar.zst", []byte("package"))
+
+	err = os.WriteFile(filepath.Join(dir, ".tmp-leftover"), []byte("partial"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err = cache.New(cache.Config{Dir: dir, MaxSizeMiBs: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !cached(c, "/core/os/x86_64/linux-6.0.pkg.tar.zst") {
+		t.Fatalf("expected file stored by a previous cache to be cached")
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, ".tmp-leftover")); !os.IsNotExist(err) {
+		t.Fatalf("expected partially written file to be removed")
+	}
+}
+
+func TestCache_Keeps_Stale_Files(t *testing.T) {
+	t.Parallel()
+
+	const path = "/core/os/x86_64/linux-6.0.pkg.tar.zst"
+
+	for _, tc := range []struct {
+		name       string
+		serveStale bool
+		size       int64
+	}{
+		{name: "removed", serveStale: false, size: 0},
+		{name: "kept", serveStale: true, size: int64(len("package"))},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			c, err := cache.New(cache.Config{
+				Dir:         t.TempDir(),
+				MaxSizeMiBs: 1,
+				Rules:       []cache.Rule{{Suffix: ".pkg.tar.zst", TTL: time.Nanosecond}},
+				ServeStale:  tc.serveStale,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			store(t, c, path, []byte("package"))
+			time.Sleep(time.Millisecond)
+
+			if cached(c, path) {
+				t.Fatalf("expected expired file not to be returned by Get")
+			}
+
+			file, _, hit := c.GetStale(path)
+			if hit != tc.serveStale {
+				t.Fatalf("expected stale file to be returned: %v, got %v", tc.serveStale, hit)
+			}
+
+			if hit {
+				contents, err := io.ReadAll(file)
+				_ = file.Close()
+				if err != nil || string(contents) != "package" {
+					t.Fatalf("expected stale contents to be %q, got %q (%v)", "package", contents, err)
+				}
+			}
+
+			if size := c.Size(); size != tc.size {
+				t.Fatalf("expected cache to hold %d bytes, got %d", tc.size, size)
+			}
+		})
+	}
+}
+
+func TestCache_Revalidates_Files(t *testing.T) {
+	t.Parallel()
+
+	const path = "/core/os/x86_64/core.db"
+
+	for _, tc := range []struct {
+		name       string
+		ttl        time.Duration
+		etag       string
+		revalidate bool
+		hit        bool
+	}{
+		{name: "always", ttl: 0, etag: `"v1"`, revalidate: true},
+		{name: "expired", ttl: time.Nanosecond, etag: `"v1"`, revalidate: true},
+		{name: "fresh", ttl: time.Hour, etag: `"v1"`, hit: true},
+		{name: "no validators", ttl: 0},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			c, err := cache.New(cache.Config{
+				Dir:         t.TempDir(),
+				MaxSizeMiBs: 1,
+				Rules:       []cache.Rule{{Suffix: ".db", TTL: tc.ttl, Revalidate: true}},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			w, err := c.Create(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, _ = w.Write([]byte("database"))
+			w.SetValidators(tc.etag, "")
+			err = w.Commit()
+			if err != nil {
+				t.Fatal(err)
+			}
+			time.Sleep(time.Millisecond)
+
+			if hit := cached(c, path); hit != tc.hit {
+				t.Fatalf("expected Get to return the file: %v, got %v", tc.hit, hit)
+			}
+
+			etag, _, revalidate := c.Validators(path)
+			if revalidate != tc.revalidate || (revalidate && etag != tc.etag) {
+				t.Fatalf("expected file to be revalidated: %v, got %v with ETag %q", tc.revalidate, revalidate, etag)
+			}
+
+			file, _, refreshed := c.Refresh(path)
+			if refreshed != (tc.hit || tc.revalidate) {
+				t.Fatalf("expected file to be kept for revalidation")
+			}
+			if refreshed {
+				_ = file.Close()
+			}
+		})
+	}
+}
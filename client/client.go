@@ -5,8 +5,10 @@ import (
 	"fmt"
 	"github.com/rs/dnscache"
 	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/http/httpproxy"
 	"net"
 	"net/http"
+	"net/url"
 	"strings"
 	"time"
 )
@@ -17,11 +19,93 @@ type Client struct {
 	HTTPClient *http.Client
 	resolver   *dnscache.Resolver
 	baseUrl    string
+	rewrites   Rewrites
+	headers    ForwardHeaders
+	drop       []string
 }
 
 type Config struct {
 	PreDownloadTimeout time.Duration `yaml:"preDownloadTimeout"`
 	DownloadTimeout    time.Duration `yaml:"downloadTimeout"`
+
+	// MaxIdleConns is the maximum number of idle connections kept open to a mirror. Defaults to 2.
+	MaxIdleConns int `yaml:"maxIdleConns"`
+	// IdleConnTimeout is the time after which idle connections to a mirror are closed. Defaults to PreDownloadTimeout.
+	IdleConnTimeout time.Duration `yaml:"idleConnTimeout"`
+
+	// MaxRedirects is the maximum number of redirects followed when requesting a file from a mirror. Request
+	// headers, including Range, are sent again to the redirect target. A negative value disables following
+	// redirects, which will then be treated as errors.
+	MaxRedirects int `yaml:"maxRedirects"`
+
+	// MaxResponseHeaderKiBs limits the size of the response headers a mirror can send, protecting refractor from
+	// broken or malicious mirrors sending enormous headers. Defaults to 64 KiB.
+	MaxResponseHeaderKiBs int64 `yaml:"maxResponseHeaderKiBs"`
+
+	// HTTP2 allows negotiating HTTP/2 with mirrors that support it over TLS. By default HTTP/1.1 is used, opening a
+	// connection per concurrent request, which tends to perform better for large downloads than multiplexing them
+	// over a single HTTP/2 connection.
+	HTTP2 bool `yaml:"http2"`
+
+	// Resolver is the address (host:port) of a DNS server used to resolve mirror hostnames. If empty, the system
+	// resolver is used.
+	Resolver string `yaml:"resolver"`
+
+	// Rewrites modify the path requested to certain mirrors. Rewrites must be compiled before creating clients.
+	Rewrites Rewrites `yaml:"rewrites"`
+
+	// ForwardHeaders lists the client headers that are sent to mirrors, in addition to Range. If empty, all client
+	// headers are forwarded. Hop-by-hop headers, such as Connection, are never forwarded.
+	ForwardHeaders ForwardHeaders `yaml:"forwardHeaders"`
+	// DropHeaders lists client headers that are never sent to mirrors, even if forwarded by ForwardHeaders. This
+	// allows forwarding all headers but a few, like Authorization or Cookie. Range cannot be dropped.
+	DropHeaders []string `yaml:"dropHeaders"`
+
+	// Proxy configures the proxies used to reach mirrors. If left empty, proxies are read from the HTTP_PROXY,
+	// HTTPS_PROXY and NO_PROXY environment variables.
+	Proxy ProxyConfig `yaml:"proxy"`
+}
+
+// dnsResolver returns a resolver querying the configured DNS server, or nil if none is configured.
+func (c Config) dnsResolver() dnscache.DNSResolver {
+	if c.Resolver == "" {
+		return nil
+	}
+
+	dialer := &net.Dialer{
+		Timeout: c.PreDownloadTimeout,
+	}
+
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, network, c.Resolver)
+		},
+	}
+}
+
+type ProxyConfig struct {
+	HTTP  string `yaml:"http"`
+	HTTPS string `yaml:"https"`
+	// NoProxy is a list of hosts, domains or CIDRs for which no proxy will be used, following the same format as
+	// NO_PROXY.
+	NoProxy []string `yaml:"noProxy"`
+}
+
+func (pc ProxyConfig) empty() bool {
+	return pc.HTTP == "" && pc.HTTPS == "" && len(pc.NoProxy) == 0
+}
+
+func (pc ProxyConfig) proxyFunc() func(*http.Request) (*url.URL, error) {
+	proxyURL := (&httpproxy.Config{
+		HTTPProxy:  pc.HTTP,
+		HTTPSProxy: pc.HTTPS,
+		NoProxy:    strings.Join(pc.NoProxy, ","),
+	}).ProxyFunc()
+
+	return func(r *http.Request) (*url.URL, error) {
+		return proxyURL(r.URL)
+	}
 }
 
 func (c Config) WithDefaults() Config {
@@ -33,20 +117,71 @@ func (c Config) WithDefaults() Config {
 		c.DownloadTimeout = 2 * time.Minute
 	}
 
+	if c.MaxIdleConns == 0 {
+		c.MaxIdleConns = 2
+	}
+
+	if c.IdleConnTimeout == 0 {
+		c.IdleConnTimeout = c.PreDownloadTimeout
+	}
+
+	if c.MaxRedirects == 0 {
+		c.MaxRedirects = 10
+	}
+
+	if c.MaxResponseHeaderKiBs == 0 {
+		c.MaxResponseHeaderKiBs = 64
+	}
+
 	return c
 }
 
 type Request struct {
+	// Method is the HTTP method used to request the file from the mirror. Defaults to GET.
+	Method       string
 	Path         string
 	Header       http.Header
 	ResponseChan chan Response
+	// Context, if set, bounds the request to the mirror. Requests whose context is done are answered with an error
+	// instead of being requeued.
+	Context context.Context
+	// Exclude lists the workers that already failed to serve this request, which should leave it to a different one.
+	Exclude []string
+	// Handoffs counts how many times the request has been left to a different worker.
+	Handoffs int
+	// ID identifies the download the request is part of in logs.
+	ID string
+}
+
+// Excludes returns whether worker should leave the request to a different one. To prevent requests from bouncing
+// indefinitely, this stops being the case once the request has been handed off more times than workers it excludes.
+func (r Request) Excludes(worker string) bool {
+	if r.Handoffs > len(r.Exclude) {
+		return false
+	}
+
+	for _, excluded := range r.Exclude {
+		if excluded == worker {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Expired returns whether the request's context is done, meaning the request should not be attempted again.
+func (r Request) Expired() bool {
+	return r.Context != nil && r.Context.Err() != nil
 }
 
 type Response struct {
 	HTTPResponse *http.Response
+	Mirror       string
 	Worker       string
 	Error        error
-	Done         func(written int64)
+	// Done is called once the body has been relayed, with the amount of bytes written and the time spent waiting on
+	// bandwidth limits, which is not the mirror's fault.
+	Done func(written int64, throttled time.Duration)
 }
 
 func NewClient(c Config, baseUrl string) *Client {
@@ -56,7 +191,9 @@ func NewClient(c Config, baseUrl string) *Client {
 		Timeout: c.PreDownloadTimeout,
 	}
 
-	resolver := &dnscache.Resolver{}
+	resolver := &dnscache.Resolver{
+		Resolver: c.dnsResolver(),
+	}
 
 	// Stolen from https://github.com/rs/dnscache
 	dialContext := func(ctx context.Context, network string, addr string) (conn net.Conn, err error) {
@@ -77,22 +214,50 @@ func NewClient(c Config, baseUrl string) *Client {
 		return
 	}
 
+	proxy := http.ProxyFromEnvironment
+	if !c.Proxy.empty() {
+		proxy = c.Proxy.proxyFunc()
+	}
+
+	// Each client talks to a single mirror, so the per-host idle limit is effectively the total limit. As a custom
+	// DialContext is used, HTTP/2 is only attempted if explicitly enabled.
 	transport := &http.Transport{
-		Proxy:                 http.ProxyFromEnvironment,
-		DialContext:           dialContext,
-		MaxIdleConns:          10,
-		ResponseHeaderTimeout: c.PreDownloadTimeout,
-		IdleConnTimeout:       c.PreDownloadTimeout,
-		TLSHandshakeTimeout:   c.PreDownloadTimeout,
+		Proxy:                  proxy,
+		DialContext:            dialContext,
+		MaxIdleConns:           c.MaxIdleConns,
+		MaxIdleConnsPerHost:    c.MaxIdleConns,
+		ResponseHeaderTimeout:  c.PreDownloadTimeout,
+		IdleConnTimeout:        c.IdleConnTimeout,
+		TLSHandshakeTimeout:    c.PreDownloadTimeout,
+		MaxResponseHeaderBytes: c.MaxResponseHeaderKiBs * 1024,
+		ForceAttemptHTTP2:      c.HTTP2,
 	}
 
 	return &Client{
 		HTTPClient: &http.Client{
-			Transport: transport,
-			Timeout:   c.DownloadTimeout,
+			Transport:     transport,
+			Timeout:       c.DownloadTimeout,
+			CheckRedirect: checkRedirect(c.MaxRedirects),
 		},
 		baseUrl:  baseUrl,
 		resolver: resolver,
+		rewrites: c.Rewrites.forMirror(baseUrl),
+		headers:  c.ForwardHeaders,
+		drop:     c.DropHeaders,
+	}
+}
+
+func checkRedirect(max int) func(*http.Request, []*http.Request) error {
+	return func(req *http.Request, via []*http.Request) error {
+		if max < 0 {
+			return fmt.Errorf("refusing redirect to %s", req.URL.String())
+		}
+
+		if len(via) > max {
+			return fmt.Errorf("stopped after %d redirects", max)
+		}
+
+		return nil
 	}
 }
 
@@ -100,16 +265,22 @@ func (c *Client) String() string {
 	return c.baseUrl
 }
 
+// Close closes idle connections to the mirror. Clients are not expected to be used after being closed.
+func (c *Client) Close() {
+	c.HTTPClient.CloseIdleConnections()
+}
+
 func (c *Client) URL(path string) string {
 	url := strings.TrimSuffix(c.baseUrl, "/")
 	url += "/"
-	url += strings.TrimPrefix(path, "/")
+	url += strings.TrimPrefix(c.rewrites.apply(path), "/")
 
 	return url
 }
 
 func (c *Client) Do(request Request) (r Response) {
 	c.resolver.Refresh(true)
+	r.Mirror = c.String()
 
 	// TODO: Calculate a better deadline by making a HEAD request and a target throughput
 	//ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(2*time.Second))
@@ -117,14 +288,23 @@ func (c *Client) Do(request Request) (r Response) {
 
 	url := c.URL(request.Path)
 
-	//req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
-	req, err := http.NewRequest(http.MethodGet, url, nil)
+	ctx := request.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	method := request.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, url, nil)
 	if err != nil {
 		r.Error = fmt.Errorf("building request to %s: %w", url, err)
 		return
 	}
 
-	req.Header = request.Header
+	req.Header = c.headers.filter(request.Header, c.drop)
 	log.Debugf("%s %s", req.Method, req.URL.String())
 	resp, err := c.HTTPClient.Do(req)
 	if err != nil {
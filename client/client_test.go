@@ -0,0 +1,141 @@
+package client_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"roob.re/refractor/client"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestClient_Follows_Redirects(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name         string
+		maxRedirects int
+		redirects    int
+		followed     bool
+	}{
+		{name: "refused", maxRedirects: -1, redirects: 1},
+		{name: "within limit", maxRedirects: 2, redirects: 2, followed: true},
+		{name: "over limit", maxRedirects: 2, redirects: 3},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			ranges := make(chan string, 1)
+			mirror := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+				// /redirect/n redirects to /redirect/n-1, until /redirect/0 serves the file.
+				left, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/redirect/"))
+				if left > 0 {
+					http.Redirect(rw, r, fmt.Sprintf("/redirect/%d", left-1), http.StatusFound)
+					return
+				}
+
+				ranges <- r.Header.Get("Range")
+				rw.WriteHeader(http.StatusPartialContent)
+			}))
+			t.Cleanup(mirror.Close)
+
+			cli := client.NewClient(client.Config{MaxRedirects: tc.maxRedirects}, mirror.URL+"/")
+			response := cli.Do(client.Request{
+				Path:   fmt.Sprintf("/redirect/%d", tc.redirects),
+				Header: http.Header{"Range": {"bytes=10-"}},
+			})
+
+			if !tc.followed {
+				if response.Error == nil {
+					_ = response.HTTPResponse.Body.Close()
+					t.Fatal("expected redirects not to be followed")
+				}
+				return
+			}
+
+			if response.Error != nil {
+				t.Fatal(response.Error)
+			}
+			_ = response.HTTPResponse.Body.Close()
+
+			if got := <-ranges; got != "bytes=10-" {
+				t.Fatalf("expected Range to be sent again to the redirect target, got %q", got)
+			}
+		})
+	}
+}
+
+func TestClient_Uses_Configured_Proxies(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name    string
+		mirror  string
+		proxy   func(proxyURL string) client.ProxyConfig
+		proxied bool
+	}{
+		{
+			name:    "http",
+			mirror:  "http://mirror.example/",
+			proxy:   func(proxyURL string) client.ProxyConfig { return client.ProxyConfig{HTTP: proxyURL} },
+			proxied: true,
+		},
+		{
+			name:    "https",
+			mirror:  "https://mirror.example/",
+			proxy:   func(proxyURL string) client.ProxyConfig { return client.ProxyConfig{HTTPS: proxyURL} },
+			proxied: true,
+		},
+		{
+			name:   "other scheme",
+			mirror: "http://mirror.example/",
+			proxy:  func(proxyURL string) client.ProxyConfig { return client.ProxyConfig{HTTPS: proxyURL} },
+		},
+		{
+			name:   "no proxy",
+			mirror: "http://mirror.example/",
+			proxy: func(proxyURL string) client.ProxyConfig {
+				return client.ProxyConfig{HTTP: proxyURL, NoProxy: []string{"mirror.example"}}
+			},
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			requested := make(chan string, 1)
+			proxy := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+				requested <- r.Host
+				if r.Method == http.MethodConnect {
+					// Tunnelling is not needed to tell the proxy was used.
+					rw.WriteHeader(http.StatusBadGateway)
+				}
+			}))
+			t.Cleanup(proxy.Close)
+
+			// The mirror hostname does not resolve, as the resolver points to a closed port, so it can only be reached
+			// through the proxy.
+			config := client.Config{Proxy: tc.proxy(proxy.URL), Resolver: "127.0.0.1:1"}
+			response := client.NewClient(config, tc.mirror).Do(client.Request{Path: "/file"})
+			if response.Error == nil {
+				_ = response.HTTPResponse.Body.Close()
+			}
+
+			select {
+			case host := <-requested:
+				if !tc.proxied {
+					t.Fatalf("expected %s not to be requested through the proxy", host)
+				}
+				if !strings.HasPrefix(host, "mirror.example") {
+					t.Fatalf("expected proxy to be asked for mirror.example, got %q", host)
+				}
+			default:
+				if tc.proxied {
+					t.Fatalf("expected request to go through the proxy, got %v", response.Error)
+				}
+			}
+		})
+	}
+}
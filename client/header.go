@@ -0,0 +1,60 @@
+package client
+
+import (
+	"net/http"
+	"strings"
+)
+
+// hopByHopHeaders are only meaningful for a single connection, and are never forwarded to mirrors.
+// https://www.rfc-editor.org/rfc/rfc9110#section-7.6.1
+var hopByHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"TE",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// ForwardHeaders is a list of client headers sent to mirrors. If empty, all headers are forwarded.
+type ForwardHeaders []string
+
+// filter returns a copy of header containing only the headers that should be sent to mirrors. Headers in drop are
+// removed, except for Range.
+func (fh ForwardHeaders) filter(header http.Header, drop []string) http.Header {
+	filtered := http.Header{}
+	if len(fh) == 0 {
+		for name, values := range header {
+			filtered[name] = append([]string(nil), values...)
+		}
+	}
+
+	// Range is needed to resume downloads, so it is always forwarded.
+	for _, name := range append([]string{"Range"}, fh...) {
+		if values := header.Values(name); len(values) > 0 {
+			filtered[http.CanonicalHeaderKey(name)] = append([]string(nil), values...)
+		}
+	}
+
+	// Headers listed in Connection are hop-by-hop as well.
+	for _, value := range header.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			filtered.Del(strings.TrimSpace(name))
+		}
+	}
+
+	for _, name := range hopByHopHeaders {
+		filtered.Del(name)
+	}
+
+	for _, name := range drop {
+		if !strings.EqualFold(name, "Range") {
+			filtered.Del(name)
+		}
+	}
+
+	return filtered
+}
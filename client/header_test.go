@@ -0,0 +1,96 @@
+package client_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"roob.re/refractor/client"
+	"strings"
+	"testing"
+)
+
+func TestClient_Forwards_Headers(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name      string
+		forward   client.ForwardHeaders
+		drop      []string
+		sent      http.Header
+		forwarded []string
+		stripped  []string
+	}{
+		{
+			name:      "all by default",
+			sent:      http.Header{"Range": {"bytes=10-"}, "If-Modified-Since": {"Wed, 21 Oct 2015 07:28:00 GMT"}, "X-Auth": {"token"}},
+			forwarded: []string{"Range", "If-Modified-Since", "X-Auth"},
+		},
+		{
+			name:      "allowlisted",
+			forward:   client.ForwardHeaders{"x-auth"},
+			sent:      http.Header{"Range": {"bytes=10-"}, "If-Modified-Since": {"Wed, 21 Oct 2015 07:28:00 GMT"}, "X-Auth": {"token"}},
+			forwarded: []string{"Range", "X-Auth"},
+			stripped:  []string{"If-Modified-Since"},
+		},
+		{
+			name:      "dropped",
+			drop:      []string{"authorization", "Range"},
+			sent:      http.Header{"Range": {"bytes=10-"}, "Authorization": {"Basic dXNlcjpwYXNz"}, "X-Auth": {"token"}},
+			forwarded: []string{"Range", "X-Auth"},
+			stripped:  []string{"Authorization"},
+		},
+		{
+			name:      "hop-by-hop",
+			forward:   client.ForwardHeaders{"Keep-Alive", "X-Auth"},
+			sent:      http.Header{"Connection": {"X-Hop"}, "X-Hop": {"1"}, "Keep-Alive": {"timeout=5"}, "X-Auth": {"token"}},
+			forwarded: []string{"X-Auth"},
+			stripped:  []string{"X-Hop", "Keep-Alive"},
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			received := make(chan http.Header, 1)
+			mirror := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+				received <- r.Header
+			}))
+			t.Cleanup(mirror.Close)
+
+			cli := client.NewClient(client.Config{ForwardHeaders: tc.forward, DropHeaders: tc.drop}, mirror.URL+"/")
+			response := cli.Do(client.Request{Path: "/file", Header: tc.sent})
+			if response.Error != nil {
+				t.Fatal(response.Error)
+			}
+			_ = response.HTTPResponse.Body.Close()
+
+			header := <-received
+			for _, name := range tc.forwarded {
+				if header.Get(name) != tc.sent.Get(name) {
+					t.Fatalf("expected %s to be forwarded as %q, got %q", name, tc.sent.Get(name), header.Get(name))
+				}
+			}
+
+			for _, name := range tc.stripped {
+				if header.Get(name) != "" {
+					t.Fatalf("expected %s not to be forwarded, got %q", name, header.Get(name))
+				}
+			}
+		})
+	}
+}
+
+func TestClient_Limits_Response_Headers(t *testing.T) {
+	t.Parallel()
+
+	mirror := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("X-Bomb", strings.Repeat("x", 8*1024))
+	}))
+	t.Cleanup(mirror.Close)
+
+	cli := client.NewClient(client.Config{MaxResponseHeaderKiBs: 4}, mirror.URL+"/")
+	response := cli.Do(client.Request{Path: "/file"})
+	if response.Error == nil {
+		_ = response.HTTPResponse.Body.Close()
+		t.Fatal("expected oversized headers to be rejected")
+	}
+}
@@ -0,0 +1,99 @@
+package client
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Rewrite modifies the path requested to mirrors whose URL matches a regular expression, allowing mirrors with
+// different layouts to be combined in a single pool.
+type Rewrite struct {
+	// Mirror is a regular expression matched against the mirror URL. If empty, the rewrite applies to all mirrors.
+	Mirror string `yaml:"mirror"`
+
+	// Prefix is replaced with Replacement if the path starts with it.
+	Prefix string `yaml:"prefix"`
+	// Regex, if set instead of Prefix, is a regular expression whose matches are replaced with Replacement. The
+	// replacement may reference capture groups, e.g. $1.
+	Regex string `yaml:"regex"`
+
+	Replacement string `yaml:"replacement"`
+
+	mirror *regexp.Regexp
+	regex  *regexp.Regexp
+}
+
+func (rw *Rewrite) compile() error {
+	if (rw.Prefix == "") == (rw.Regex == "") {
+		return fmt.Errorf("rewrite must define exactly one of prefix or regex")
+	}
+
+	var err error
+	if rw.Mirror != "" {
+		rw.mirror, err = regexp.Compile(rw.Mirror)
+		if err != nil {
+			return fmt.Errorf("compiling mirror regex: %w", err)
+		}
+	}
+
+	if rw.Regex != "" {
+		rw.regex, err = regexp.Compile(rw.Regex)
+		if err != nil {
+			return fmt.Errorf("compiling path regex: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func (rw *Rewrite) appliesTo(mirror string) bool {
+	return rw.mirror == nil || rw.mirror.MatchString(mirror)
+}
+
+func (rw *Rewrite) apply(path string) string {
+	if rw.regex != nil {
+		return rw.regex.ReplaceAllString(path, rw.Replacement)
+	}
+
+	if strings.HasPrefix(path, rw.Prefix) {
+		return rw.Replacement + strings.TrimPrefix(path, rw.Prefix)
+	}
+
+	return path
+}
+
+// Rewrites is a list of rewrites, applied in order.
+type Rewrites []Rewrite
+
+// Compile validates the rewrites and prepares them to be applied. It must be called before creating clients.
+func (rws Rewrites) Compile() error {
+	for i := range rws {
+		err := rws[i].compile()
+		if err != nil {
+			return fmt.Errorf("rewrite #%d: %w", i, err)
+		}
+	}
+
+	return nil
+}
+
+// forMirror returns the rewrites that apply to the given mirror URL.
+func (rws Rewrites) forMirror(mirror string) Rewrites {
+	var applicable Rewrites
+	for _, rw := range rws {
+		if rw.appliesTo(mirror) {
+			applicable = append(applicable, rw)
+		}
+	}
+
+	return applicable
+}
+
+func (rws Rewrites) apply(path string) string {
+	for i := range rws {
+		path = rws[i].apply(path)
+	}
+
+	return path
+}
@@ -0,0 +1,40 @@
+package client_test
+
+import (
+	"roob.re/refractor/client"
+	"testing"
+)
+
+func TestClient_URL_Rewrites(t *testing.T) {
+	t.Parallel()
+
+	rewrites := client.Rewrites{
+		{Mirror: `^https://arch\.example/`, Prefix: "/archlinux/", Replacement: "/arch/"},
+		{Regex: `^/iso/([0-9.]+)/`, Replacement: "/iso/v$1/"},
+	}
+
+	err := rewrites.Compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		mirror   string
+		path     string
+		expected string
+	}{
+		{mirror: "https://arch.example/", path: "/archlinux/core.db", expected: "https://arch.example/arch/core.db"},
+		{mirror: "https://other.example/", path: "/archlinux/core.db", expected: "https://other.example/archlinux/core.db"},
+		{mirror: "https://other.example/", path: "/iso/2022.06.01/arch.iso", expected: "https://other.example/iso/v2022.06.01/arch.iso"},
+	} {
+		tc := tc
+		t.Run(tc.expected, func(t *testing.T) {
+			t.Parallel()
+
+			cli := client.NewClient(client.Config{Rewrites: rewrites}, tc.mirror)
+			if url := cli.URL(tc.path); url != tc.expected {
+				t.Fatalf("expected %q, got %q", tc.expected, url)
+			}
+		})
+	}
+}
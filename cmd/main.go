@@ -4,12 +4,14 @@ import (
 	"flag"
 	log "github.com/sirupsen/logrus"
 	"os"
+	"os/signal"
 	"roob.re/refractor/server"
+	"syscall"
 )
 
 func main() {
 	configPath := flag.String("config", "refractor.yaml", "Path to refractor.yaml file")
-	address := flag.String("address", ":8080", "Address to listen on")
+	address := flag.String("address", "", "Address to listen on, overriding listenAddress from the config file")
 	logLvl := flag.String("log-level", "info", "Verbosity level. Accepts levels understood by logrus")
 	flag.Parse()
 
@@ -30,8 +32,32 @@ func main() {
 		log.Fatalf("Could not create server: %v", err)
 	}
 
+	go reloadOnHangup(s, *configPath)
+
 	err = s.Run(*address)
 	if err != nil {
 		log.Errorf("Server exited with error: %v", err)
 	}
 }
+
+// reloadOnHangup reloads the config file every time SIGHUP is received.
+func reloadOnHangup(s *server.Server, configPath string) {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+
+	for range hangups {
+		log.Infof("Received SIGHUP, reloading %s", configPath)
+
+		config, err := os.Open(configPath)
+		if err != nil {
+			log.Errorf("Could not open %s: %v", configPath, err)
+			continue
+		}
+
+		err = s.Reload(config)
+		_ = config.Close()
+		if err != nil {
+			log.Errorf("Could not reload config, keeping current rules: %v", err)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+// Package metrics defines the minimal interface refractor uses to report metrics, so the core does not depend on any
+// particular metrics backend.
+package metrics
+
+// Names of the metrics emitted by refractor.
+const (
+	// Requests counts requests served to clients, labeled by result and class.
+	Requests = "refractor_requests_total"
+	// Retries counts requests re-enqueued to a different worker after a retryable error.
+	Retries = "refractor_retries_total"
+	// Evictions counts workers removed from the pool, labeled by reason: either for performing poorly
+	// (performance) or for returning an error (error).
+	Evictions = "refractor_worker_evictions_total"
+	// TruncatedResponses counts responses where the mirror sent fewer bytes than announced, labeled by mirror.
+	TruncatedResponses = "refractor_truncated_responses_total"
+	// ClientWriteFailures counts downloads aborted because writing to the client failed midway, usually because it
+	// disconnected, labeled by the mirror that was serving them.
+	ClientWriteFailures = "refractor_client_write_failures_total"
+	// ResponseBytes observes the amount of bytes written to the client per response, labeled by mirror and class.
+	ResponseBytes = "refractor_response_bytes"
+	// ResponseDuration observes the time it took to write a response to the client, in seconds, labeled by mirror and
+	// class.
+	ResponseDuration = "refractor_response_duration_seconds"
+	// TimeToFirstByte observes the time from receiving a request to starting to write the response to the client, in
+	// seconds, labeled by mirror and class. It includes retries and peeking.
+	TimeToFirstByte = "refractor_time_to_first_byte_seconds"
+	// UpstreamBytes observes the amount of bytes downloaded from a mirror per attempt, labeled by mirror. Unlike
+	// ResponseBytes, it includes attempts that were aborted and retried elsewhere.
+	UpstreamBytes = "refractor_upstream_bytes"
+	// EgressBytes is the amount of bytes downloaded from mirrors during the current egress accounting period.
+	EgressBytes = "refractor_egress_period_bytes"
+	// Attempts counts requests sent to mirrors, labeled by mirror and result: either ok or error. Attempts that fail
+	// because of the client, or because they were canceled, are not counted.
+	Attempts = "refractor_attempts_total"
+	// Downloads is the amount of requests currently being served.
+	Downloads = "refractor_downloads"
+	// MirrorDownloads is the amount of requests each mirror is currently serving, labeled by mirror.
+	MirrorDownloads = "refractor_mirror_downloads"
+	// Workers is the amount of workers currently serving requests.
+	Workers = "refractor_workers"
+)
+
+// Names of the labels attached to metrics.
+const (
+	LabelResult = "result"
+	LabelMirror = "mirror"
+	LabelReason = "reason"
+	// LabelClass is the class of the request, as tagged by rules.
+	LabelClass = "class"
+)
+
+// Labels is a set of label names and values attached to a metric.
+type Labels map[string]string
+
+// Metrics is implemented by metrics backends.
+type Metrics interface {
+	IncCounter(name string, labels Labels)
+	ObserveHistogram(name string, value float64, labels Labels)
+	SetGauge(name string, value float64, labels Labels)
+}
+
+// Nop is a Metrics implementation that discards everything.
+type Nop struct{}
+
+func (Nop) IncCounter(string, Labels)                {}
+func (Nop) ObserveHistogram(string, float64, Labels) {}
+func (Nop) SetGauge(string, float64, Labels)         {}
@@ -0,0 +1,144 @@
+// Package prometheus implements metrics.Metrics on top of the Prometheus client library.
+package prometheus
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"roob.re/refractor/metrics"
+	"sort"
+	"sync"
+)
+
+// help contains the descriptions of the metrics emitted by refractor.
+var help = map[string]string{
+	metrics.Requests:            "Requests served to clients.",
+	metrics.Retries:             "Requests retried on a different worker.",
+	metrics.Evictions:           "Workers removed from the pool.",
+	metrics.TruncatedResponses:  "Responses where the mirror sent less than announced.",
+	metrics.ClientWriteFailures: "Downloads aborted because writing to the client failed.",
+	metrics.ResponseBytes:       "Bytes written to the client per response.",
+	metrics.ResponseDuration:    "Time spent writing a response to the client, in seconds.",
+	metrics.TimeToFirstByte:     "Time from receiving a request to starting the response, in seconds.",
+	metrics.UpstreamBytes:       "Bytes downloaded from a mirror per attempt.",
+	metrics.EgressBytes:         "Bytes downloaded from mirrors during the current egress period.",
+	metrics.Attempts:            "Requests sent to mirrors.",
+	metrics.Downloads:           "Requests currently being served.",
+	metrics.MirrorDownloads:     "Requests currently being served by each mirror.",
+	metrics.Workers:             "Workers currently in the pool.",
+}
+
+// buckets are the histogram buckets used for each metric. Metrics not listed use the Prometheus defaults, which suit
+// durations in seconds.
+var buckets = map[string][]float64{
+	// From 64KiB to 4GiB.
+	metrics.ResponseBytes: prometheus.ExponentialBuckets(64*1024, 4, 9),
+	metrics.UpstreamBytes: prometheus.ExponentialBuckets(64*1024, 4, 9),
+	// Downloads of large files can take a long time.
+	metrics.ResponseDuration: prometheus.ExponentialBuckets(0.1, 3, 10),
+}
+
+// Metrics registers metrics in a Prometheus registerer as they are first emitted. The label names of a metric are
+// taken from the first time it is emitted, and must not change afterwards.
+type Metrics struct {
+	registerer prometheus.Registerer
+
+	mtx        sync.Mutex
+	counters   map[string]*prometheus.CounterVec
+	histograms map[string]*prometheus.HistogramVec
+	gauges     map[string]*prometheus.GaugeVec
+}
+
+// New returns a Metrics registering metrics in registerer.
+func New(registerer prometheus.Registerer) *Metrics {
+	return &Metrics{
+		registerer: registerer,
+		counters:   map[string]*prometheus.CounterVec{},
+		histograms: map[string]*prometheus.HistogramVec{},
+		gauges:     map[string]*prometheus.GaugeVec{},
+	}
+}
+
+func (m *Metrics) IncCounter(name string, labels metrics.Labels) {
+	m.mtx.Lock()
+	vec, found := m.counters[name]
+	if !found {
+		vec = prometheus.NewCounterVec(prometheus.CounterOpts{Name: name, Help: describe(name)}, labelNames(labels))
+		m.register(name, vec)
+		m.counters[name] = vec
+	}
+	m.mtx.Unlock()
+
+	counter, err := vec.GetMetricWith(prometheus.Labels(labels))
+	if err != nil {
+		log.Errorf("Incrementing %s: %v", name, err)
+		return
+	}
+
+	counter.Inc()
+}
+
+func (m *Metrics) ObserveHistogram(name string, value float64, labels metrics.Labels) {
+	m.mtx.Lock()
+	vec, found := m.histograms[name]
+	if !found {
+		opts := prometheus.HistogramOpts{Name: name, Help: describe(name), Buckets: buckets[name]}
+		vec = prometheus.NewHistogramVec(opts, labelNames(labels))
+		m.register(name, vec)
+		m.histograms[name] = vec
+	}
+	m.mtx.Unlock()
+
+	histogram, err := vec.GetMetricWith(prometheus.Labels(labels))
+	if err != nil {
+		log.Errorf("Observing %s: %v", name, err)
+		return
+	}
+
+	histogram.Observe(value)
+}
+
+func (m *Metrics) SetGauge(name string, value float64, labels metrics.Labels) {
+	m.mtx.Lock()
+	vec, found := m.gauges[name]
+	if !found {
+		vec = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: name, Help: describe(name)}, labelNames(labels))
+		m.register(name, vec)
+		m.gauges[name] = vec
+	}
+	m.mtx.Unlock()
+
+	gauge, err := vec.GetMetricWith(prometheus.Labels(labels))
+	if err != nil {
+		log.Errorf("Setting %s: %v", name, err)
+		return
+	}
+
+	gauge.Set(value)
+}
+
+// register registers collector, logging instead of failing if it cannot be registered, so metrics never take
+// refractor down.
+func (m *Metrics) register(name string, collector prometheus.Collector) {
+	err := m.registerer.Register(collector)
+	if err != nil {
+		log.Errorf("Registering %s: %v", name, err)
+	}
+}
+
+func describe(name string) string {
+	if description, found := help[name]; found {
+		return description
+	}
+
+	return name
+}
+
+func labelNames(labels metrics.Labels) []string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return names
+}
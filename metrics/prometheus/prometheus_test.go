@@ -0,0 +1,44 @@
+package prometheus_test
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"roob.re/refractor/metrics"
+	prommetrics "roob.re/refractor/metrics/prometheus"
+	"strings"
+	"testing"
+)
+
+func TestMetrics_Registers_On_First_Use(t *testing.T) {
+	t.Parallel()
+
+	registry := prometheus.NewRegistry()
+	m := prommetrics.New(registry)
+
+	ok := metrics.Labels{metrics.LabelResult: "ok", metrics.LabelClass: ""}
+	m.IncCounter(metrics.Requests, ok)
+	m.IncCounter(metrics.Requests, ok)
+	m.IncCounter(metrics.Requests, metrics.Labels{metrics.LabelResult: "error", metrics.LabelClass: ""})
+	// Inconsistent labels are dropped instead of panicking.
+	m.IncCounter(metrics.Requests, metrics.Labels{metrics.LabelMirror: "https://mirror.example/"})
+	m.SetGauge(metrics.Workers, 8, nil)
+	m.ObserveHistogram(metrics.ResponseBytes, 1024, metrics.Labels{metrics.LabelMirror: "https://mirror.example/"})
+
+	expected := `
+# HELP refractor_requests_total Requests served to clients.
+# TYPE refractor_requests_total counter
+refractor_requests_total{class="",result="error"} 1
+refractor_requests_total{class="",result="ok"} 2
+# HELP refractor_workers Workers currently in the pool.
+# TYPE refractor_workers gauge
+refractor_workers 8
+`
+	err := testutil.GatherAndCompare(registry, strings.NewReader(expected), metrics.Requests, metrics.Workers)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if count := testutil.CollectAndCount(registry, metrics.ResponseBytes); count != 1 {
+		t.Fatalf("expected one %s series, got %d", metrics.ResponseBytes, count)
+	}
+}
@@ -0,0 +1,125 @@
+package pool
+
+import (
+	"encoding/json"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// AuditRecord describes how a request was served. If an audit sink is configured, a record is written to it as a JSON
+// line after every request.
+type AuditRecord struct {
+	Time   time.Time `json:"time"`
+	Path   string    `json:"path"`
+	Class  string    `json:"class,omitempty"`
+	Mirror string    `json:"mirror,omitempty"`
+	// Source tells where the response came from if it was not sent by Mirror: "cache" for files served from the cache,
+	// and "rule" for requests answered by rules. Mirror is empty unless the cached copy was revalidated with it.
+	Source string `json:"source,omitempty"`
+	// Status is the status sent to the client, which may differ from the one returned by the mirror, e.g. if retries
+	// were exhausted. It is zero if the client went away before the response started.
+	Status          int     `json:"status,omitempty"`
+	Bytes           int64   `json:"bytes"`
+	DurationSeconds float64 `json:"durationSeconds"`
+	Retries         int     `json:"retries"`
+	Error           string  `json:"error,omitempty"`
+}
+
+func (d *download) auditRecord() AuditRecord {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	record := AuditRecord{
+		Time:            d.started,
+		Path:            d.path,
+		Class:           d.class,
+		Mirror:          d.mirror,
+		Source:          d.source,
+		Status:          int(atomic.LoadInt32(&d.status)),
+		Bytes:           atomic.LoadInt64(&d.written),
+		DurationSeconds: time.Since(d.started).Seconds(),
+		Retries:         d.retries,
+	}
+
+	if d.err != nil {
+		record.Error = d.err.Error()
+	}
+
+	return record
+}
+
+// auditLocal writes the record of a request answered by the pool itself from source, rather than by a mirror, and
+// which started at started. lw is the writer the response was sent through.
+func (p *Pool) auditLocal(path, class, source string, started time.Time, lw *localWriter) {
+	p.audit(AuditRecord{
+		Time:            started,
+		Path:            path,
+		Class:           class,
+		Source:          source,
+		Status:          lw.status,
+		Bytes:           lw.bytes,
+		DurationSeconds: time.Since(started).Seconds(),
+	})
+}
+
+func (p *Pool) audit(record AuditRecord) {
+	if p.Audit == nil {
+		return
+	}
+
+	p.auditMtx.Lock()
+	defer p.auditMtx.Unlock()
+
+	err := json.NewEncoder(p.Audit).Encode(record)
+	if err != nil {
+		log.Errorf("Writing audit record for %s: %v", record.Path, err)
+	}
+}
+
+// statusWriter records the status sent to the client in the audit record of dl.
+// localWriter records the status and size of a response the pool answers itself, for its audit record.
+type localWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (lw *localWriter) WriteHeader(status int) {
+	if lw.status == 0 {
+		lw.status = status
+	}
+	lw.ResponseWriter.WriteHeader(status)
+}
+
+func (lw *localWriter) Write(b []byte) (int, error) {
+	if lw.status == 0 {
+		lw.status = http.StatusOK
+	}
+	n, err := lw.ResponseWriter.Write(b)
+	lw.bytes += int64(n)
+	return n, err
+}
+
+type statusWriter struct {
+	http.ResponseWriter
+	dl *download
+}
+
+func (sw statusWriter) WriteHeader(status int) {
+	// As with net/http, only the first status counts.
+	atomic.CompareAndSwapInt32(&sw.dl.status, 0, int32(status))
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+func (sw statusWriter) Write(b []byte) (int, error) {
+	atomic.CompareAndSwapInt32(&sw.dl.status, 0, http.StatusOK)
+	return sw.ResponseWriter.Write(b)
+}
+
+func (sw statusWriter) Flush() {
+	if flusher, ok := sw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,61 @@
+package pool
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// maxRetryBackoff caps the delay between retries, however many there have been.
+const maxRetryBackoff = 10 * time.Second
+
+// retryDelay returns how long to wait before the given retry, starting at 1. The delay doubles with every retry, and
+// is randomized between half and all of it so retries of concurrent requests do not happen in lockstep.
+func retryDelay(base time.Duration, retry int) time.Duration {
+	delay := base
+	for i := 1; i < retry && delay < maxRetryBackoff; i++ {
+		delay *= 2
+	}
+
+	if delay > maxRetryBackoff {
+		delay = maxRetryBackoff
+	}
+
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// cooldowns keeps track of mirrors that were evicted recently, so they are not fed to the pool again right away.
+type cooldowns struct {
+	mtx   sync.Mutex
+	until map[string]time.Time
+}
+
+// start puts mirror on cooldown for d.
+func (c *cooldowns) start(mirror string, d time.Duration) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if c.until == nil {
+		c.until = map[string]time.Time{}
+	}
+
+	c.until[mirror] = time.Now().Add(d)
+}
+
+// active returns whether mirror is still on cooldown.
+func (c *cooldowns) active(mirror string) bool {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	until, found := c.until[mirror]
+	if !found {
+		return false
+	}
+
+	if time.Now().After(until) {
+		delete(c.until, mirror)
+		return false
+	}
+
+	return true
+}
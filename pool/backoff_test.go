@@ -0,0 +1,47 @@
+package pool
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRetryDelay(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		retry int
+		max   time.Duration
+	}{
+		{retry: 1, max: 100 * time.Millisecond},
+		{retry: 2, max: 200 * time.Millisecond},
+		{retry: 3, max: 400 * time.Millisecond},
+		{retry: 20, max: maxRetryBackoff},
+	} {
+		for i := 0; i < 100; i++ {
+			delay := retryDelay(100*time.Millisecond, tc.retry)
+			if delay < tc.max/2 || delay > tc.max {
+				t.Fatalf("expected delay for retry %d to be between %v and %v, got %v", tc.retry, tc.max/2, tc.max, delay)
+			}
+		}
+	}
+}
+
+func TestCooldowns(t *testing.T) {
+	t.Parallel()
+
+	c := cooldowns{}
+	c.start("https://broken.example/", time.Hour)
+	c.start("https://flaky.example/", -time.Second)
+
+	if !c.active("https://broken.example/") {
+		t.Fatal("expected mirror to be on cooldown")
+	}
+
+	if c.active("https://flaky.example/") {
+		t.Fatal("expected cooldown to be over")
+	}
+
+	if c.active("https://healthy.example/") {
+		t.Fatal("expected mirror that was never evicted not to be on cooldown")
+	}
+}
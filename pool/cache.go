@@ -0,0 +1,383 @@
+package pool
+
+import (
+	"context"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net/http"
+	"roob.re/refractor/cache"
+	"strconv"
+	"time"
+)
+
+// Cache stores files downloaded from mirrors, so further requests for them can be served without contacting any
+// mirror. cache.Cache stores them on disk, and other storage, like memory or an object store, can be plugged in when
+// using refractor as a library.
+type Cache interface {
+	// Cacheable returns whether path would be stored in the cache.
+	Cacheable(path string) bool
+	// Get returns the cached contents of path, and the time they were stored. It returns false if path is not cached,
+	// or if it has expired. The caller must close the returned file.
+	Get(path string) (io.ReadSeekCloser, time.Time, bool)
+	// GetStale returns the cached contents of path as Get does, even if they have expired. It is used when mirrors fail
+	// to serve a fresh copy, and returns false if path is not cached or stale files are not kept.
+	GetStale(path string) (io.ReadSeekCloser, time.Time, bool)
+	// Validators returns the ETag and Last-Modified headers the cached copy of path was served with, either of which may
+	// be empty, if it has expired and should be revalidated with mirrors rather than downloaded again.
+	Validators(path string) (etag string, lastModified string, ok bool)
+	// Refresh marks the cached copy of path as fresh again, after a mirror reported it did not change, and returns it
+	// as Get does.
+	Refresh(path string) (io.ReadSeekCloser, time.Time, bool)
+	// Create returns an entry to which the contents of path are written as they are sent to the client. The entry is
+	// committed only if the response was sent in full, and discarded otherwise.
+	Create(path string) (cache.Entry, error)
+	// Size returns the total size, in bytes, of the files in the cache.
+	Size() int64
+}
+
+var _ Cache = (*cache.Cache)(nil)
+
+// serveCached answers r from the cache, if it holds the requested path. It returns false if the path is not cached,
+// in which case nothing has been written to rw.
+func (p *Pool) serveCached(rw http.ResponseWriter, r *http.Request, class string) bool {
+	if p.Cache == nil || (r.Method != http.MethodGet && r.Method != http.MethodHead) {
+		return false
+	}
+
+	file, stored, hit := p.Cache.Get(r.URL.Path)
+	if !hit {
+		return false
+	}
+	defer file.Close()
+
+	log.Debugf("Serving %s from cache", r.URL.Path)
+	p.countRequest("cached", class)
+	started := time.Now()
+	lw := &localWriter{ResponseWriter: rw}
+	// ServeContent takes care of ranges and conditional requests.
+	http.ServeContent(lw, r, r.URL.Path, stored, file)
+	p.auditLocal(r.URL.Path, class, "cache", started, lw)
+	return true
+}
+
+// staleWarning is sent along with stale files, as defined by RFC 7234.
+const staleWarning = `110 - "Response is Stale"`
+
+// serveStale answers r with a stale copy of the requested path, if the cache kept one, after mirrors failed to serve
+// a fresh one. It returns false if there is no such copy, in which case nothing has been written to rw.
+func (p *Pool) serveStale(rw http.ResponseWriter, r *http.Request, logger *log.Entry) bool {
+	if p.Cache == nil || (r.Method != http.MethodGet && r.Method != http.MethodHead) {
+		return false
+	}
+
+	file, stored, found := p.Cache.GetStale(r.URL.Path)
+	if !found {
+		return false
+	}
+	defer file.Close()
+
+	logger.Warnf("Serving stale copy of %s stored at %s from cache", r.URL.Path, stored.Format(time.RFC3339))
+	rw.Header().Set("Warning", staleWarning)
+	http.ServeContent(rw, r, r.URL.Path, stored, file)
+	return true
+}
+
+// serveRevalidated answers r with the cached copy of the requested path, after a mirror reported it did not change. It
+// returns false if the copy was removed from the cache in the meantime, in which case nothing has been written to rw.
+func (p *Pool) serveRevalidated(rw http.ResponseWriter, r *http.Request, logger *log.Entry) bool {
+	file, stored, found := p.Cache.Refresh(r.URL.Path)
+	if !found {
+		return false
+	}
+	defer file.Close()
+
+	logger.Debugf("Serving %s from cache, as it did not change", r.URL.Path)
+	http.ServeContent(rw, r, r.URL.Path, stored, file)
+	return true
+}
+
+// revalidation returns r made conditional on the validators of the cached copy of its path, if it has expired and
+// should be revalidated, and makes cw hold back a 304 Not Modified response so the cached copy can be sent instead.
+// Otherwise, or if the client made a conditional request itself, it returns r.
+func (p *Pool) revalidation(r *http.Request, cw *cachingWriter) *http.Request {
+	if cw == nil || r.Header.Get("If-None-Match") != "" || r.Header.Get("If-Modified-Since") != "" {
+		return r
+	}
+
+	etag, lastModified, revalidate := p.Cache.Validators(r.URL.Path)
+	if !revalidate {
+		return r
+	}
+
+	conditional := r.Clone(r.Context())
+	if etag != "" {
+		conditional.Header.Set("If-None-Match", etag)
+	}
+	if lastModified != "" {
+		conditional.Header.Set("If-Modified-Since", lastModified)
+	}
+
+	cw.revalidating = true
+	return conditional
+}
+
+// cachingWriter copies the body sent to the client to the cache, so it can be committed once the response has been
+// sent successfully.
+type cachingWriter struct {
+	http.ResponseWriter
+	path   string
+	logger *log.Entry
+	entry  cache.Entry
+	status int
+	failed bool
+	// prefetch makes the writer keep writing to the cache after writing to the client fails, which is then recorded
+	// in clientErr.
+	prefetch  bool
+	clientErr error
+	// revalidating makes the writer hold back headers until it is known whether the mirror answered with 304 Not
+	// Modified, which is recorded in notModified and not sent to the client.
+	revalidating bool
+	notModified  bool
+	header       http.Header
+	// bufferBytes, if not zero, makes the body be written to the client through buffer, so writing to the cache can
+	// get ahead of a slow client.
+	bufferBytes int
+	buffer      *clientBuffer
+}
+
+// caches returns whether the response to r should be stored in the cache. Partial responses are not cached.
+func (p *Pool) caches(r *http.Request) bool {
+	return p.Cache != nil && r.Method == http.MethodGet && r.Header.Get("Range") == "" && p.Cache.Cacheable(r.URL.Path)
+}
+
+// cachingWriter returns a cachingWriter wrapping rw if the response to r should be stored in the cache, or nil
+// otherwise. Problems writing to the cache are logged to logger.
+func (p *Pool) cachingWriter(rw http.ResponseWriter, r *http.Request, logger *log.Entry) *cachingWriter {
+	if !p.caches(r) {
+		return nil
+	}
+
+	entry, err := p.Cache.Create(r.URL.Path)
+	if err != nil {
+		logger.Warnf("Not caching %s: %v", r.URL.Path, err)
+		return nil
+	}
+
+	return &cachingWriter{
+		ResponseWriter: rw,
+		path:           r.URL.Path,
+		logger:         logger,
+		entry:          entry,
+		prefetch:       p.CachePrefetch,
+		bufferBytes:    int(p.CacheBufferMiBs * 1024 * 1024),
+	}
+}
+
+func (cw *cachingWriter) Header() http.Header {
+	if cw.revalidating {
+		if cw.header == nil {
+			cw.header = http.Header{}
+		}
+		return cw.header
+	}
+
+	return cw.ResponseWriter.Header()
+}
+
+func (cw *cachingWriter) WriteHeader(status int) {
+	if cw.revalidating {
+		if status == http.StatusNotModified {
+			cw.notModified = true
+			return
+		}
+
+		// The mirror sent the file anew, so it is passed to the client and cached as usual.
+		for name, values := range cw.header {
+			cw.ResponseWriter.Header()[name] = values
+		}
+		cw.revalidating, cw.header = false, nil
+	}
+
+	if cw.status == 0 {
+		cw.status = status
+	}
+
+	cw.ResponseWriter.WriteHeader(status)
+}
+
+func (cw *cachingWriter) Write(b []byte) (int, error) {
+	if cw.notModified {
+		return len(b), nil
+	}
+
+	if cw.status == 0 {
+		cw.WriteHeader(http.StatusOK)
+	}
+
+	if cw.clientErr != nil {
+		// Once the client is gone, the body is only written to the cache, so there is no point in going on if it will
+		// not be cached.
+		cw.writeEntry(b)
+		if cw.failed {
+			return 0, cw.clientErr
+		}
+
+		return len(b), nil
+	}
+
+	n, err := cw.writeClient(b)
+	if err != nil && cw.prefetch && !cw.failed {
+		cw.logger.Infof("Client went away, prefetching the rest of %s into the cache", cw.path)
+		cw.clientErr = err
+		n, err = len(b), nil
+	}
+
+	cw.writeEntry(b[:n])
+	return n, err
+}
+
+// writeClient writes b to the client, through the buffer if there is one.
+func (cw *cachingWriter) writeClient(b []byte) (int, error) {
+	if cw.bufferBytes == 0 {
+		return cw.ResponseWriter.Write(b)
+	}
+
+	// Headers have been written already, so only the body goes through the buffer.
+	if cw.buffer == nil {
+		cw.buffer = newClientBuffer(cw.ResponseWriter, cw.bufferBytes)
+	}
+
+	err := cw.buffer.write(b)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(b), nil
+}
+
+// writeEntry writes b to the cache entry, unless writing to it already failed.
+func (cw *cachingWriter) writeEntry(b []byte) {
+	if cw.failed {
+		return
+	}
+
+	_, err := cw.entry.Write(b)
+	if err != nil {
+		cw.logger.Warnf("Not caching %s: %v", cw.path, err)
+		cw.failed = true
+	}
+}
+
+func (cw *cachingWriter) Flush() {
+	// The buffer flushes the body itself, as it must be the only one writing to the client.
+	if cw.clientErr != nil || cw.revalidating || cw.buffer != nil {
+		return
+	}
+
+	if flusher, ok := cw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// commit stores the body in the cache, if it was sent with a 200 status and received in full, and then waits for it to
+// be written to the client, if it is buffered. As the cache has the whole body by then, it is stored regardless of
+// the client, and the error writing to it is returned, unless the file was being prefetched.
+func (cw *cachingWriter) commit() error {
+	if cw == nil {
+		return nil
+	}
+
+	cw.store()
+	return cw.drain()
+}
+
+// store commits the cache entry, or discards it if the body was not sent with a 200 status or received in full.
+func (cw *cachingWriter) store() {
+	if cw.status != http.StatusOK || cw.failed {
+		cw.entry.Discard()
+		return
+	}
+
+	if cl := cw.Header().Get("Content-Length"); cl != "" && cl != strconv.FormatInt(cw.entry.Size(), 10) {
+		cw.logger.Warnf("Not caching %s, as its size does not match its Content-Length", cw.path)
+		cw.entry.Discard()
+		return
+	}
+
+	cw.entry.SetValidators(cw.Header().Get("ETag"), cw.Header().Get("Last-Modified"))
+	err := cw.entry.Commit()
+	if err != nil {
+		cw.logger.Warnf("Could not cache %s: %v", cw.path, err)
+		return
+	}
+
+	cw.logger.Debugf("Stored %s in cache", cw.path)
+}
+
+// drain waits for the buffered body, if any, to be written to the client, and returns the error doing so, unless the
+// file was being prefetched.
+func (cw *cachingWriter) drain() error {
+	if cw.buffer == nil {
+		return nil
+	}
+
+	err := cw.buffer.close()
+	if err != nil && cw.prefetch {
+		cw.clientErr = err
+		return nil
+	}
+
+	if err != nil {
+		return fmt.Errorf("%w: %v", errClientWrite, err)
+	}
+
+	return nil
+}
+
+// revalidated returns whether a mirror answered that the cached copy being revalidated did not change.
+func (cw *cachingWriter) revalidated() bool {
+	return cw != nil && cw.notModified
+}
+
+// stopRevalidating makes the writer pass responses through as usual, so the file can be downloaded again.
+func (cw *cachingWriter) stopRevalidating() {
+	cw.revalidating, cw.notModified, cw.header = false, false, nil
+}
+
+// prefetched returns whether the client went away before the body was written in full, which was then only written to
+// the cache.
+func (cw *cachingWriter) prefetched() bool {
+	return cw != nil && cw.clientErr != nil
+}
+
+// detachedContext carries the values of its parent, but is not canceled along with it, so prefetches outlive the
+// request of the client that started them.
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func (detachedContext) Done() <-chan struct{} {
+	return nil
+}
+
+func (detachedContext) Err() error {
+	return nil
+}
+
+// discard drops whatever has been written to the cache so far. It does nothing if the body was already committed.
+func (cw *cachingWriter) discard() {
+	if cw == nil {
+		return
+	}
+
+	if cw.buffer != nil {
+		cw.buffer.stop()
+	}
+
+	cw.entry.Discard()
+}
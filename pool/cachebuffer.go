@@ -0,0 +1,114 @@
+package pool
+
+import (
+	"net/http"
+	"sync"
+)
+
+// clientBuffer writes a response to the client in the background, so whoever writes to it can get up to maxBytes ahead
+// of the client. It is used to keep a slow client from stalling the transfer of a file being cached.
+type clientBuffer struct {
+	rw       http.ResponseWriter
+	maxBytes int
+
+	mtx  sync.Mutex
+	cond *sync.Cond
+	// chunks are waiting to be written to the client, and add up to size bytes.
+	chunks [][]byte
+	size   int
+	closed bool
+	// err is the error writing to the client. Once set, pending chunks are dropped.
+	err  error
+	done chan struct{}
+}
+
+// newClientBuffer returns a clientBuffer writing to rw, which must not be used directly until the buffer is closed.
+func newClientBuffer(rw http.ResponseWriter, maxBytes int) *clientBuffer {
+	cb := &clientBuffer{rw: rw, maxBytes: maxBytes, done: make(chan struct{})}
+	cb.cond = sync.NewCond(&cb.mtx)
+	go cb.run()
+
+	return cb
+}
+
+// write queues a copy of b to be written to the client, waiting while the buffer is full. It returns the error writing
+// to the client, if a previous write failed.
+func (cb *clientBuffer) write(b []byte) error {
+	cb.mtx.Lock()
+	defer cb.mtx.Unlock()
+
+	// Chunks larger than the buffer are let through once it is empty.
+	for cb.err == nil && cb.size > 0 && cb.size+len(b) > cb.maxBytes {
+		cb.cond.Wait()
+	}
+
+	if cb.err != nil {
+		return cb.err
+	}
+
+	cb.chunks = append(cb.chunks, append([]byte(nil), b...))
+	cb.size += len(b)
+	cb.cond.Broadcast()
+	return nil
+}
+
+func (cb *clientBuffer) run() {
+	defer close(cb.done)
+
+	for {
+		cb.mtx.Lock()
+		for len(cb.chunks) == 0 && !cb.closed {
+			cb.cond.Wait()
+		}
+
+		if len(cb.chunks) == 0 {
+			cb.mtx.Unlock()
+			return
+		}
+
+		chunk := cb.chunks[0]
+		cb.chunks = cb.chunks[1:]
+		drained := len(cb.chunks) == 0
+		cb.mtx.Unlock()
+
+		_, err := cb.rw.Write(chunk)
+		// Flushing once the buffer is drained keeps data from lingering in the response buffer while the mirror
+		// stalls.
+		if flusher, ok := cb.rw.(http.Flusher); ok && err == nil && drained {
+			flusher.Flush()
+		}
+
+		cb.mtx.Lock()
+		cb.size -= len(chunk)
+		if err != nil {
+			cb.err = err
+			cb.chunks, cb.size = nil, 0
+		}
+		cb.cond.Broadcast()
+		cb.mtx.Unlock()
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+// close waits until everything queued has been written to the client, and returns the error writing it, if any.
+func (cb *clientBuffer) close() error {
+	cb.mtx.Lock()
+	cb.closed = true
+	cb.cond.Broadcast()
+	cb.mtx.Unlock()
+
+	<-cb.done
+	return cb.err
+}
+
+// stop drops whatever has not been written to the client yet, and waits for a write in progress to finish.
+func (cb *clientBuffer) stop() {
+	cb.mtx.Lock()
+	cb.chunks, cb.size = nil, 0
+	cb.mtx.Unlock()
+
+	_ = cb.close()
+}
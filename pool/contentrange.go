@@ -0,0 +1,128 @@
+package pool
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var errRangeMismatch = errors.New("content range does not match requested range")
+
+// contentRange is a parsed Content-Range header. Total is -1 if the mirror did not disclose the size of the file.
+type contentRange struct {
+	start, end, total int64
+}
+
+// parseContentRange parses a Content-Range header of the form "bytes start-end/total", where total may be "*".
+func parseContentRange(header string) (contentRange, error) {
+	if !strings.HasPrefix(header, "bytes ") {
+		return contentRange{}, fmt.Errorf("unsupported content range %q", header)
+	}
+
+	span, total, found := strings.Cut(strings.TrimPrefix(header, "bytes "), "/")
+	if !found {
+		return contentRange{}, fmt.Errorf("content range %q has no total", header)
+	}
+
+	first, last, found := strings.Cut(span, "-")
+	if !found {
+		return contentRange{}, fmt.Errorf("content range %q has no end", header)
+	}
+
+	cr := contentRange{total: -1}
+	var err error
+	cr.start, err = strconv.ParseInt(first, 10, 64)
+	if err != nil {
+		return contentRange{}, fmt.Errorf("parsing content range start: %w", err)
+	}
+
+	cr.end, err = strconv.ParseInt(last, 10, 64)
+	if err != nil {
+		return contentRange{}, fmt.Errorf("parsing content range end: %w", err)
+	}
+
+	if total != "*" {
+		cr.total, err = strconv.ParseInt(total, 10, 64)
+		if err != nil {
+			return contentRange{}, fmt.Errorf("parsing content range total: %w", err)
+		}
+	}
+
+	if cr.start < 0 || cr.end < cr.start || (cr.total >= 0 && cr.end >= cr.total) {
+		return contentRange{}, fmt.Errorf("invalid content range %q", header)
+	}
+
+	return cr, nil
+}
+
+// checkContentRange verifies that the Content-Range header of a 206 response covers exactly the single range
+// requested in the Range header. Requests for multiple ranges, or with a Range header that cannot be parsed, are not
+// checked, as mirrors answer them in ways that cannot be compared against a single Content-Range.
+func checkContentRange(requested, header string) error {
+	if !strings.HasPrefix(requested, "bytes=") || strings.Contains(requested, ",") {
+		return nil
+	}
+
+	first, last, found := strings.Cut(strings.TrimSpace(strings.TrimPrefix(requested, "bytes=")), "-")
+	if !found {
+		return nil
+	}
+
+	cr, err := parseContentRange(header)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errRangeMismatch, err)
+	}
+
+	// Suffix ranges, like bytes=-500, request the last bytes of the file.
+	if first == "" {
+		suffix, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || cr.total < 0 {
+			return nil
+		}
+
+		start := cr.total - suffix
+		if start < 0 {
+			start = 0
+		}
+
+		if cr.start != start || cr.end != cr.total-1 {
+			return fmt.Errorf("%w: requested %q, got %q", errRangeMismatch, requested, header)
+		}
+
+		return nil
+	}
+
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil {
+		return nil
+	}
+
+	if cr.start != start {
+		return fmt.Errorf("%w: requested %q, got %q", errRangeMismatch, requested, header)
+	}
+
+	// Open ranges, like bytes=500-, and ranges past the end of the file end at the last byte.
+	if last == "" {
+		if cr.total >= 0 && cr.end != cr.total-1 {
+			return fmt.Errorf("%w: requested %q, got %q", errRangeMismatch, requested, header)
+		}
+
+		return nil
+	}
+
+	end, err := strconv.ParseInt(last, 10, 64)
+	if err != nil {
+		return nil
+	}
+
+	if cr.total >= 0 && end >= cr.total {
+		end = cr.total - 1
+	}
+
+	if cr.end != end {
+		return fmt.Errorf("%w: requested %q, got %q", errRangeMismatch, requested, header)
+	}
+
+	return nil
+}
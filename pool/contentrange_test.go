@@ -0,0 +1,86 @@
+package pool
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseContentRange(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name     string
+		header   string
+		expected contentRange
+		fails    bool
+	}{
+		{name: "Known_Total", header: "bytes 0-499/1000", expected: contentRange{start: 0, end: 499, total: 1000}},
+		{name: "Unknown_Total", header: "bytes 500-999/*", expected: contentRange{start: 500, end: 999, total: -1}},
+		{name: "Single_Byte", header: "bytes 999-999/1000", expected: contentRange{start: 999, end: 999, total: 1000}},
+		{name: "Unsatisfied", header: "bytes */1000", fails: true},
+		{name: "Other_Unit", header: "items 0-1/2", fails: true},
+		{name: "No_Total", header: "bytes 0-499", fails: true},
+		{name: "End_Before_Start", header: "bytes 500-499/1000", fails: true},
+		{name: "End_Past_Total", header: "bytes 0-1000/1000", fails: true},
+		{name: "Garbage", header: "bytes a-b/c", fails: true},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			cr, err := parseContentRange(tc.header)
+			if tc.fails {
+				if err == nil {
+					t.Fatalf("expected %q to fail to parse, got %+v", tc.header, cr)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("parsing %q: %v", tc.header, err)
+			}
+
+			if cr != tc.expected {
+				t.Fatalf("expected %+v, got %+v", tc.expected, cr)
+			}
+		})
+	}
+}
+
+func TestCheckContentRange(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name      string
+		requested string
+		header    string
+		ok        bool
+	}{
+		{name: "Exact", requested: "bytes=0-499", header: "bytes 0-499/1000", ok: true},
+		{name: "Open", requested: "bytes=500-", header: "bytes 500-999/1000", ok: true},
+		{name: "Open_Unknown_Total", requested: "bytes=500-", header: "bytes 500-999/*", ok: true},
+		{name: "Past_End", requested: "bytes=500-2000", header: "bytes 500-999/1000", ok: true},
+		{name: "Suffix", requested: "bytes=-100", header: "bytes 900-999/1000", ok: true},
+		{name: "Suffix_Larger_Than_File", requested: "bytes=-2000", header: "bytes 0-999/1000", ok: true},
+		{name: "Multiple_Ranges", requested: "bytes=0-1,5-6", header: "", ok: true},
+		{name: "Different_Start", requested: "bytes=500-", header: "bytes 0-999/1000"},
+		{name: "Different_End", requested: "bytes=0-499", header: "bytes 0-999/1000"},
+		{name: "Short_Open", requested: "bytes=500-", header: "bytes 500-899/1000"},
+		{name: "Different_Suffix", requested: "bytes=-100", header: "bytes 800-999/1000"},
+		{name: "Missing_Header", requested: "bytes=0-499", header: ""},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			err := checkContentRange(tc.requested, tc.header)
+			if tc.ok && err != nil {
+				t.Fatalf("expected %q to match %q, got %v", tc.header, tc.requested, err)
+			}
+
+			if !tc.ok && !errors.Is(err, errRangeMismatch) {
+				t.Fatalf("expected %q not to match %q, got %v", tc.header, tc.requested, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,155 @@
+package pool
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"net/http"
+	"strings"
+)
+
+const (
+	contentDigestHeader = "Content-Digest"
+	// digestHeader is the older Digest header, from RFC 3230, superseded by Content-Digest.
+	digestHeader     = "Digest"
+	contentMD5Header = "Content-MD5"
+)
+
+var (
+	errNoKnownDigest  = errors.New("no supported algorithm found")
+	errDigestMismatch = errors.New("digest mismatch")
+)
+
+// digester computes digests for the written bytes using all algorithms that can be found in a Content-Digest field,
+// as specified in RFC 9530.
+type digester map[string]hash.Hash
+
+func newDigester() digester {
+	return digester{
+		"sha-256": sha256.New(),
+		"sha-512": sha512.New(),
+	}
+}
+
+func (d digester) Write(p []byte) (int, error) {
+	for _, h := range d {
+		// hash.Hash.Write never returns an error.
+		_, _ = h.Write(p)
+	}
+
+	return len(p), nil
+}
+
+// Verify checks the digests computed so far against the supplied Content-Digest field value. Algorithms not known
+// to digester are ignored, but at least one known algorithm must be present.
+func (d digester) Verify(field string) error {
+	verified := false
+	for _, member := range strings.Split(field, ",") {
+		alg, value, found := strings.Cut(strings.TrimSpace(member), "=")
+		if !found {
+			return fmt.Errorf("malformed digest %q", member)
+		}
+
+		h, known := d[strings.ToLower(alg)]
+		if !known {
+			continue
+		}
+
+		// Digest values are encoded as RFC 8941 byte sequences, i.e. base64 surrounded by colons.
+		expected, err := base64.StdEncoding.DecodeString(strings.Trim(value, ":"))
+		if err != nil {
+			return fmt.Errorf("decoding %s digest: %w", alg, err)
+		}
+
+		if !bytes.Equal(h.Sum(nil), expected) {
+			return fmt.Errorf("%s %w", alg, errDigestMismatch)
+		}
+
+		verified = true
+	}
+
+	if !verified {
+		return errNoKnownDigest
+	}
+
+	return nil
+}
+
+// bodyDigest checks the body of a response against a digest announced by the mirror in the response headers.
+type bodyDigest struct {
+	header   string
+	alg      string
+	expected []byte
+	hash     hash.Hash
+}
+
+// announcedDigest returns a bodyDigest for the strongest digest announced in the Content-Digest, Digest or
+// Content-MD5 headers, in that order of preference, or nil if none of them carries a supported digest.
+func announcedDigest(header http.Header) (*bodyDigest, error) {
+	for _, name := range []string{contentDigestHeader, digestHeader} {
+		field := header.Get(name)
+		if field == "" {
+			continue
+		}
+
+		digests := map[string][]byte{}
+		for _, member := range strings.Split(field, ",") {
+			alg, value, found := strings.Cut(strings.TrimSpace(member), "=")
+			if !found {
+				return nil, fmt.Errorf("malformed %s %q", name, member)
+			}
+
+			// Content-Digest values are surrounded by colons, while Digest values are not.
+			sum, err := base64.StdEncoding.DecodeString(strings.Trim(value, ":"))
+			if err != nil {
+				return nil, fmt.Errorf("decoding %s %s: %w", name, alg, err)
+			}
+
+			digests[strings.ToLower(alg)] = sum
+		}
+
+		if sum, found := digests["sha-512"]; found {
+			return &bodyDigest{header: name, alg: "sha-512", expected: sum, hash: sha512.New()}, nil
+		}
+
+		if sum, found := digests["sha-256"]; found {
+			return &bodyDigest{header: name, alg: "sha-256", expected: sum, hash: sha256.New()}, nil
+		}
+
+		// MD5 is deprecated for Content-Digest, but still common in Digest.
+		if sum, found := digests["md5"]; found && name == digestHeader {
+			return &bodyDigest{header: name, alg: "md5", expected: sum, hash: md5.New()}, nil
+		}
+	}
+
+	if field := header.Get(contentMD5Header); field != "" {
+		sum, err := base64.StdEncoding.DecodeString(field)
+		if err != nil {
+			return nil, fmt.Errorf("decoding %s: %w", contentMD5Header, err)
+		}
+
+		return &bodyDigest{header: contentMD5Header, alg: "md5", expected: sum, hash: md5.New()}, nil
+	}
+
+	return nil, nil
+}
+
+func (bd *bodyDigest) Write(p []byte) (int, error) {
+	// hash.Hash.Write never returns an error.
+	_, _ = bd.hash.Write(p)
+	return len(p), nil
+}
+
+// Verify checks the bytes written so far against the announced digest.
+func (bd *bodyDigest) Verify() error {
+	if !bytes.Equal(bd.hash.Sum(nil), bd.expected) {
+		return fmt.Errorf("%s %s %w", bd.header, bd.alg, errDigestMismatch)
+	}
+
+	return nil
+}
@@ -0,0 +1,51 @@
+package pool
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"testing"
+)
+
+func TestDigester_Verify(t *testing.T) {
+	t.Parallel()
+
+	const body = "lorem ipsum dolor sit amet"
+	sum := sha256.Sum256([]byte(body))
+	good := base64.StdEncoding.EncodeToString(sum[:])
+	bad := base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))
+
+	for _, tc := range []struct {
+		name  string
+		field string
+		ok    bool
+		err   error
+	}{
+		{name: "Matching", field: "sha-256=:" + good + ":", ok: true},
+		{name: "Matching_With_Unknown", field: "md5=:AAAA:, sha-256=:" + good + ":", ok: true},
+		{name: "Mismatching", field: "sha-256=:" + bad + ":"},
+		{name: "Unknown_Only", field: "md5=:AAAA:", err: errNoKnownDigest},
+		{name: "Malformed", field: "sha-256"},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			d := newDigester()
+			_, _ = d.Write([]byte(body))
+
+			err := d.Verify(tc.field)
+			if tc.ok && err != nil {
+				t.Fatalf("expected digest to verify, got %v", err)
+			}
+
+			if !tc.ok && err == nil {
+				t.Fatal("expected digest verification to fail")
+			}
+
+			if tc.err != nil && !errors.Is(err, tc.err) {
+				t.Fatalf("expected %v, got %v", tc.err, err)
+			}
+		})
+	}
+}
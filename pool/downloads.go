@@ -0,0 +1,284 @@
+package pool
+
+import (
+	"context"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
+	"io"
+	"net/http"
+	"roob.re/refractor/names"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Download is a snapshot of the progress of a request being served.
+type Download struct {
+	ID      string    `json:"id"`
+	Path    string    `json:"path"`
+	Class   string    `json:"class,omitempty"`
+	Mirror  string    `json:"mirror"`
+	Started time.Time `json:"started"`
+	// Size is the size of the body as announced by the mirror, or -1 if unknown.
+	Size int64 `json:"size"`
+	// Written is the amount of bytes of the body that have been written to the client.
+	Written        int64   `json:"written"`
+	ThroughputMiBs float64 `json:"throughputMiBs"`
+	// IdleSeconds is the time since the last byte was written to the client or, if none has been written yet, since
+	// the current mirror was asked for the file. A high value points to a stalled mirror.
+	IdleSeconds float64 `json:"idleSeconds"`
+}
+
+// download tracks the progress of a request while it is being served, across retries.
+type download struct {
+	id      string
+	path    string
+	class   string
+	started time.Time
+	cancel  context.CancelFunc
+	// limiters throttle the transfer to the client, on top of the bandwidth limit of the mirror itself. They are set
+	// before the download starts being served.
+	limiters []*rate.Limiter
+
+	// canceled is set, atomically, when the download is canceled through the registry.
+	canceled int32
+	// status is the status sent to the client, set atomically when the response starts.
+	status int32
+
+	mtx     sync.Mutex
+	mirror  string
+	size    int64
+	retries int
+	err     error
+	// attempts counts the responses from mirrors that have been served, or tried to, for the download.
+	attempts int
+	// tried lists the workers that have been asked for the download.
+	tried []string
+	// source is set if the response was not sent by mirror, as in AuditRecord.
+	source string
+
+	// written and progressed, the time of the last progress in Unix nanoseconds, are accessed atomically.
+	written    int64
+	progressed int64
+}
+
+// logger returns a log entry tagged with the ID of the download, so log lines about it can be told apart from those
+// about other downloads.
+func (d *download) logger() *log.Entry {
+	return log.WithField("download", d.id)
+}
+
+// attemptLogger counts a new attempt to serve the download with a response from mirror, and returns a log entry
+// tagged with the download, the mirror and the number of the attempt.
+func (d *download) attemptLogger(mirror string) *log.Entry {
+	d.mtx.Lock()
+	d.attempts++
+	attempt := d.attempts
+	d.mtx.Unlock()
+
+	return d.logger().WithFields(log.Fields{"mirror": mirror, "attempt": attempt})
+}
+
+// attempt records the mirror serving the download and the response it returned, and resets its progress.
+func (d *download) attempt(mirror string, response *http.Response) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	d.mirror = mirror
+	d.size = response.ContentLength
+	atomic.StoreInt64(&d.written, 0)
+	atomic.StoreInt64(&d.progressed, time.Now().UnixNano())
+}
+
+// result records the amount of retries the download needed, and the error that made it fail, if any.
+func (d *download) result(retries int, err error) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	d.retries = retries
+	d.err = err
+}
+
+// servedFrom records that the response was not sent by the mirror, but from source.
+func (d *download) servedFrom(source string) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	d.source = source
+}
+
+// failure returns the error recorded by result, if any.
+func (d *download) failure() error {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	return d.err
+}
+
+// try records that worker has been asked for the download.
+func (d *download) try(worker string) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	d.tried = append(d.tried, worker)
+}
+
+// triedWorkers returns the workers that have been asked for the download so far.
+func (d *download) triedWorkers() []string {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	return append([]string(nil), d.tried...)
+}
+
+// wroteBody returns whether any of the body of the response being served has been written to the client.
+func (d *download) wroteBody() bool {
+	return atomic.LoadInt64(&d.written) > 0
+}
+
+// wasCanceled returns whether the download has been canceled through the registry.
+func (d *download) wasCanceled() bool {
+	return atomic.LoadInt32(&d.canceled) == 1
+}
+
+// writer returns an io.Writer that counts bytes written through it towards the download progress.
+func (d *download) writer(w io.Writer) io.Writer {
+	return countingWriter{Writer: w, count: &d.written, progressed: &d.progressed}
+}
+
+func (d *download) snapshot() Download {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	written := atomic.LoadInt64(&d.written)
+	progressed := atomic.LoadInt64(&d.progressed)
+	if progressed == 0 {
+		progressed = d.started.UnixNano()
+	}
+
+	return Download{
+		ID:             d.id,
+		Path:           d.path,
+		Class:          d.class,
+		Mirror:         d.mirror,
+		Started:        d.started,
+		Size:           d.size,
+		Written:        written,
+		ThroughputMiBs: float64(written) / time.Since(d.started).Seconds() / 1024 / 1024,
+		IdleSeconds:    time.Since(time.Unix(0, progressed)).Seconds(),
+	}
+}
+
+type countingWriter struct {
+	io.Writer
+	count      *int64
+	progressed *int64
+}
+
+func (cw countingWriter) Write(buf []byte) (int, error) {
+	n, err := cw.Writer.Write(buf)
+	atomic.AddInt64(cw.count, int64(n))
+	if n > 0 {
+		atomic.StoreInt64(cw.progressed, time.Now().UnixNano())
+	}
+	return n, err
+}
+
+// downloads is a registry of active downloads.
+type downloads struct {
+	mtx    sync.Mutex
+	active map[string]*download
+}
+
+// start registers a new download. cancel is called if the download is canceled through the registry.
+func (ds *downloads) start(path, class string, cancel context.CancelFunc) *download {
+	ds.mtx.Lock()
+	defer ds.mtx.Unlock()
+
+	if ds.active == nil {
+		ds.active = map[string]*download{}
+	}
+
+	d := &download{
+		id:      names.Nonce(),
+		path:    path,
+		class:   class,
+		started: time.Now(),
+		cancel:  cancel,
+		size:    -1,
+	}
+	ds.active[d.id] = d
+
+	return d
+}
+
+func (ds *downloads) finish(d *download) {
+	ds.mtx.Lock()
+	defer ds.mtx.Unlock()
+
+	delete(ds.active, d.id)
+}
+
+// cancel cancels the active download with the given id. It returns false if there is no such download.
+func (ds *downloads) cancel(id string) bool {
+	ds.mtx.Lock()
+	d, found := ds.active[id]
+	ds.mtx.Unlock()
+
+	if !found {
+		return false
+	}
+
+	atomic.StoreInt32(&d.canceled, 1)
+	d.cancel()
+	return true
+}
+
+func (ds *downloads) list() []Download {
+	ds.mtx.Lock()
+	defer ds.mtx.Unlock()
+
+	list := make([]Download, 0, len(ds.active))
+	for _, d := range ds.active {
+		list = append(list, d.snapshot())
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Started.Before(list[j].Started)
+	})
+
+	return list
+}
+
+// counters is a set of counters, keyed by name.
+type counters struct {
+	mtx    sync.Mutex
+	counts map[string]int
+}
+
+// add adds delta to the counter for name, and returns its new value.
+func (c *counters) add(name string, delta int) int {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if c.counts == nil {
+		c.counts = map[string]int{}
+	}
+
+	c.counts[name] += delta
+	if c.counts[name] == 0 {
+		delete(c.counts, name)
+		return 0
+	}
+
+	return c.counts[name]
+}
+
+// get returns the value of the counter for name.
+func (c *counters) get(name string) int {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	return c.counts[name]
+}
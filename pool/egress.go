@@ -0,0 +1,91 @@
+package pool
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaultEgressPeriod is used when Config.EgressCapGiBs is set but Config.EgressPeriod is not.
+const defaultEgressPeriod = 30 * 24 * time.Hour
+
+// egress accounts the bytes downloaded from mirrors during the current period, and whether they exceed a cap.
+type egress struct {
+	mtx      sync.Mutex
+	capBytes int64
+	period   time.Duration
+	start    time.Time
+	used     int64
+}
+
+func newEgress(capGiBs float64, period time.Duration) *egress {
+	if period <= 0 {
+		period = defaultEgressPeriod
+	}
+
+	return &egress{
+		capBytes: int64(capGiBs * 1024 * 1024 * 1024),
+		period:   period,
+		start:    time.Now(),
+	}
+}
+
+// rollover starts a new period if the current one is over. It must be called with the mutex held.
+func (e *egress) rollover() {
+	if time.Since(e.start) < e.period {
+		return
+	}
+
+	e.start = time.Now()
+	e.used = 0
+}
+
+// add accounts n bytes downloaded from a mirror.
+func (e *egress) add(n int64) {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+
+	e.rollover()
+	e.used += n
+}
+
+// exceeded returns whether the cap has been reached during the current period and, if so, how long remains until the
+// next one starts.
+func (e *egress) exceeded() (bool, time.Duration) {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+
+	e.rollover()
+	if e.capBytes <= 0 || e.used < e.capBytes {
+		return false, 0
+	}
+
+	return true, e.period - time.Since(e.start)
+}
+
+// usage returns the bytes downloaded from mirrors during the current period.
+func (e *egress) usage() int64 {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+
+	e.rollover()
+	return e.used
+}
+
+// egressBody accounts bytes read from a mirror response body.
+type egressBody struct {
+	io.ReadCloser
+	egress *egress
+	read   int64 // accessed atomically
+}
+
+func (eb *egressBody) Read(buf []byte) (int, error) {
+	n, err := eb.ReadCloser.Read(buf)
+	if n > 0 {
+		atomic.AddInt64(&eb.read, int64(n))
+		eb.egress.add(int64(n))
+	}
+
+	return n, err
+}
@@ -0,0 +1,39 @@
+package pool
+
+import (
+	"context"
+	"net/http"
+	"roob.re/refractor/client"
+	"time"
+)
+
+// tryFallback requests r from the fallback mirror directly, bypassing workers. The fallback mirror is not ranked, as
+// it is only used when the pool fails to serve a request.
+func (p *Pool) tryFallback(ctx context.Context, r *http.Request, rw http.ResponseWriter, dl *download) (error, bool) {
+	return p.tryDirect(ctx, "fallback", p.fallback, r, rw, dl)
+}
+
+// tryPinned requests r from c, the client for the mirror a rule pins it to, bypassing workers.
+func (p *Pool) tryPinned(ctx context.Context, c *client.Client, r *http.Request, rw http.ResponseWriter, dl *download) (error, bool) {
+	return p.tryDirect(ctx, "pinned", c, r, rw, dl)
+}
+
+// tryDirect requests r from c, bypassing workers. Workers are named after role, and their throughput is not measured.
+func (p *Pool) tryDirect(ctx context.Context, role string, c *client.Client, r *http.Request, rw http.ResponseWriter, dl *download) (error, bool) {
+	request := client.Request{
+		Method:  upstreamMethod(r),
+		Path:    r.URL.Path,
+		Header:  r.Header,
+		Context: ctx,
+		ID:      dl.id,
+	}
+
+	response := c.Do(request)
+	response.Worker = role + ":" + c.String()
+	response.Done = func(int64, time.Duration) {}
+
+	err, retryable := p.serve(ctx, request, response, rw, dl)
+	p.countAttempt(response.Mirror, err)
+
+	return err, retryable
+}
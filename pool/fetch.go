@@ -0,0 +1,164 @@
+package pool
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// errFetchAborted is returned when reading the body of a response returned by Fetch, if the download was aborted
+// before it completed.
+var errFetchAborted = errors.New("download aborted")
+
+// Fetch downloads path from the pool, exactly as ServeHTTP would serve it to a client sending header, and returns the
+// response as soon as it starts, so the body can be read as it is downloaded. This allows using refractor as a
+// library without running an HTTP server.
+//
+// As with http.Client, requests that fail are reported through the status code of the response, and err is only
+// returned if no response could be produced at all, e.g. because ctx was canceled before it started. If the download
+// fails or is aborted after the response has started, reading the body returns an error rather than io.EOF. The body must be closed, which cancels the download if it is still in progress.
+func (p *Pool) Fetch(ctx context.Context, path string, header http.Header) (*http.Response, error) {
+	ctx, cancel := context.WithCancel(ctx)
+
+	r, err := http.NewRequestWithContext(ctx, http.MethodGet, path, nil)
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("building request for %s: %w", path, err)
+	}
+
+	if header != nil {
+		r.Header = header.Clone()
+	}
+
+	pr, pw := io.Pipe()
+	fw := &fetchWriter{header: http.Header{}, body: pw, started: make(chan struct{})}
+
+	go func() {
+		var failure error
+		defer func() {
+			recovered := recover()
+			if recovered != nil && recovered != http.ErrAbortHandler {
+				panic(recovered)
+			}
+
+			if recovered != nil && failure == nil {
+				failure = errFetchAborted
+			}
+
+			fw.finish(failure, recovered != nil)
+		}()
+
+		p.serveHTTP(fw, r, func(err error) {
+			failure = err
+		})
+	}()
+
+	<-fw.started
+	if fw.status == 0 {
+		cancel()
+		return nil, fmt.Errorf("fetching %s: %w", path, fw.err)
+	}
+
+	contentLength := int64(-1)
+	if cl, err := strconv.ParseInt(fw.sent.Get("Content-Length"), 10, 64); err == nil {
+		contentLength = cl
+	}
+
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", fw.status, http.StatusText(fw.status)),
+		StatusCode:    fw.status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        fw.sent,
+		Body:          fetchBody{PipeReader: pr, cancel: cancel},
+		ContentLength: contentLength,
+		Request:       r,
+	}, nil
+}
+
+// fetchWriter is a http.ResponseWriter that sends the body through a pipe, and signals when the response starts.
+type fetchWriter struct {
+	header http.Header
+	body   *io.PipeWriter
+
+	once    sync.Once
+	started chan struct{}
+	// status and sent, the headers as they were when the response started, are set before started is closed. Status
+	// is left at zero if the response was aborted before it started, in which case err is set instead.
+	status int
+	sent   http.Header
+	err    error
+
+	// written is the amount of bytes of the body written so far.
+	written int64
+}
+
+func (fw *fetchWriter) Header() http.Header {
+	return fw.header
+}
+
+func (fw *fetchWriter) WriteHeader(status int) {
+	fw.once.Do(func() {
+		fw.status = status
+		fw.sent = fw.header.Clone()
+		close(fw.started)
+	})
+}
+
+func (fw *fetchWriter) Write(b []byte) (int, error) {
+	fw.WriteHeader(http.StatusOK)
+	n, err := fw.body.Write(b)
+	fw.written += int64(n)
+	return n, err
+}
+
+// finish ends the response once the handler has returned, or aborted it if aborted is set. failure is the error that
+// made the download fail, if any. The body is closed with an error if the download failed after the response started,
+// or if it is shorter than its Content-Length, so readers can tell it is incomplete.
+func (fw *fetchWriter) finish(failure error, aborted bool) {
+	if failure != nil {
+		fw.once.Do(func() {
+			fw.err = failure
+			close(fw.started)
+		})
+	}
+
+	// Handlers returning without writing anything answer with an empty 200, as in net/http.
+	fw.WriteHeader(http.StatusOK)
+
+	// Failures answered with an error status, before any of the body was written, do not leave it incomplete.
+	if failure != nil && (aborted || fw.written > 0) {
+		_ = fw.body.CloseWithError(failure)
+		return
+	}
+
+	if cl, err := strconv.ParseInt(fw.sent.Get("Content-Length"), 10, 64); err == nil && cl != fw.written && bodyAllowed(fw.status) {
+		if failure == nil {
+			failure = io.ErrUnexpectedEOF
+		}
+		_ = fw.body.CloseWithError(failure)
+		return
+	}
+
+	_ = fw.body.Close()
+}
+
+// bodyAllowed returns whether a response with the given status can have a body.
+func bodyAllowed(status int) bool {
+	return status >= http.StatusOK && status != http.StatusNoContent && status != http.StatusNotModified
+}
+
+type fetchBody struct {
+	*io.PipeReader
+	cancel context.CancelFunc
+}
+
+func (fb fetchBody) Close() error {
+	fb.cancel()
+	return fb.PipeReader.Close()
+}
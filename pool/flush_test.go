@@ -0,0 +1,45 @@
+package pool
+
+import (
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type countingFlusher struct {
+	flushes int32
+}
+
+func (cf *countingFlusher) Flush() {
+	atomic.AddInt32(&cf.flushes, 1)
+}
+
+func TestFlushWriter_Flushes_After_Stall(t *testing.T) {
+	t.Parallel()
+
+	flusher := &countingFlusher{}
+	fw := &flushWriter{Writer: io.Discard, flusher: flusher, interval: 50 * time.Millisecond}
+	defer fw.stop()
+
+	// The first write flushes right away, while the second comes too soon and is flushed once the interval is over.
+	_, _ = fw.Write([]byte("first"))
+	_, _ = fw.Write([]byte("second"))
+	if flushes := atomic.LoadInt32(&flusher.flushes); flushes != 1 {
+		t.Fatalf("expected 1 flush right after writing, got %d", flushes)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if flushes := atomic.LoadInt32(&flusher.flushes); flushes != 2 {
+		t.Fatalf("expected a scheduled flush while no more data is written, got %d flushes", flushes)
+	}
+
+	// Once stopped, writes still flush if the interval is over, but nothing is scheduled.
+	fw.stop()
+	_, _ = fw.Write([]byte("third"))
+	_, _ = fw.Write([]byte("fourth"))
+	time.Sleep(100 * time.Millisecond)
+	if flushes := atomic.LoadInt32(&flusher.flushes); flushes != 3 {
+		t.Fatalf("expected no flush to be scheduled once stopped, got %d flushes", flushes)
+	}
+}
@@ -0,0 +1,88 @@
+package pool
+
+import (
+	"golang.org/x/time/rate"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// clientLimiter keeps track of the downloads being served to each client, identified by IP address, and the bandwidth
+// limit they share.
+type clientLimiter struct {
+	mtx      sync.Mutex
+	mibs     float64
+	active   map[string]int
+	limiters map[string]*rate.Limiter
+}
+
+// acquire registers a download for ip and returns true, unless ip already has max downloads in progress. A max of
+// zero means no limit.
+func (cl *clientLimiter) acquire(ip string, max int) bool {
+	cl.mtx.Lock()
+	defer cl.mtx.Unlock()
+
+	if cl.active == nil {
+		cl.active = map[string]int{}
+	}
+
+	if max > 0 && cl.active[ip] >= max {
+		return false
+	}
+
+	cl.active[ip]++
+	return true
+}
+
+// limiter returns the bandwidth limiter shared by the downloads of ip, or nil if clients are not limited. It must only
+// be called between acquire and release.
+func (cl *clientLimiter) limiter(ip string) *rate.Limiter {
+	if cl.mibs <= 0 {
+		return nil
+	}
+
+	cl.mtx.Lock()
+	defer cl.mtx.Unlock()
+
+	if cl.limiters == nil {
+		cl.limiters = map[string]*rate.Limiter{}
+	}
+
+	limiter, found := cl.limiters[ip]
+	if !found {
+		limiter = newLimiter(cl.mibs)
+		cl.limiters[ip] = limiter
+	}
+
+	return limiter
+}
+
+func (cl *clientLimiter) release(ip string) {
+	cl.mtx.Lock()
+	defer cl.mtx.Unlock()
+
+	cl.active[ip]--
+	if cl.active[ip] <= 0 {
+		delete(cl.active, ip)
+		delete(cl.limiters, ip)
+	}
+}
+
+// clientIP returns the IP address of the client that sent r. If header is not empty and present in the request, the
+// last address in it is used, as that is the one appended by the trusted proxy in front of refractor.
+func clientIP(r *http.Request, header string) string {
+	if header != "" {
+		if values := r.Header.Values(header); len(values) > 0 {
+			addresses := strings.Split(values[len(values)-1], ",")
+			return strings.TrimSpace(addresses[len(addresses)-1])
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
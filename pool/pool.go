@@ -1,26 +1,64 @@
 package pool
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	log "github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
 	"io"
 	"net/http"
+	"path"
 	"roob.re/refractor/client"
+	"roob.re/refractor/metrics"
 	"roob.re/refractor/names"
 	"roob.re/refractor/pool/peeker"
 	"roob.re/refractor/provider/types"
+	"roob.re/refractor/rules"
 	"roob.re/refractor/stats"
 	"roob.re/refractor/worker"
-	"strings"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// retriesHeader reports how many times a request was retried before the response was sent, if debug headers are
+// enabled.
+const retriesHeader = "X-Refracted-Retries"
+
+// downloadHeader reports the ID of the download, as listed by Pool.Downloads and tagged in logs, if debug headers are
+// enabled.
+const downloadHeader = "X-Refracted-Download"
+
 type Pool struct {
 	Config
-	stats  *stats.Stats
-	peeker peeker.Peeker
-	namer  func() string
+	clientConfig client.Config
+	stats        *stats.Stats
+	metrics      metrics.Metrics
+	peeker       peeker.Peeker
+	namer        func() string
+	fallback     *client.Client
+	// ruleSet holds the *ruleSet in use, which can be replaced while requests are being served.
+	ruleSet atomic.Value
+
+	// activeWorkers and activeDownloads are accessed atomically.
+	activeWorkers   int64
+	activeDownloads int64
+
+	workersMtx sync.Mutex
+	workers    map[string]worker.Worker
+
+	downloads       downloads
+	mirrorDownloads counters // Keyed by mirror URL.
+	limiter         clientLimiter
+	throttles       throttles
+	throttle        *rate.Limiter // Shared by all downloads, if MaxMiBs is set.
+	egress          *egress
+	cooldowns       cooldowns
+	recentErrors    recentErrors
+	auditMtx        sync.Mutex
 
 	clients  chan *client.Client
 	requests chan client.Request
@@ -34,36 +72,176 @@ type Config struct {
 	// expected connections to refractor, otherwise requests will be serialized.
 	Workers int `yaml:"workers"`
 
+	// RetryBackoff, if set, is the delay before the first retry of a request. It doubles with every subsequent retry,
+	// up to 10s, and is randomized to avoid retrying concurrent requests in lockstep.
+	RetryBackoff time.Duration `yaml:"retryBackoff"`
+	// MirrorCooldown, if set, is the time a mirror evicted from the pool has to wait before it can join it again, so a
+	// broken mirror is not picked again right away if the provider keeps returning it.
+	MirrorCooldown time.Duration `yaml:"mirrorCooldown"`
+
 	// PeekSizeMiBs is the amount of bytes to peek before starting to feed the response back to the client.
 	// If PeekSizeMiBs are not transferred within PeekTimeout, the request is aborted and requeued to another mirror.
 	PeekSizeMiBs int64 `yaml:"peekSizeMiBs"`
 	// PeekTimeout is the amount of time to give for PeekSizeBytes to be read before switching to another mirror.
 	PeekTimeout time.Duration `yaml:"peekTimeout"`
+
+	// RequestTimeout is a hard limit for the whole handling of a request, including retries. Requests that run out of
+	// time before anything is sent to the client are answered with 504 Gateway Timeout, while those that already
+	// started transferring are aborted. Zero, the default, disables the limit, as large downloads can take arbitrarily
+	// long.
+	RequestTimeout time.Duration `yaml:"requestTimeout"`
+
+	// MinThroughputMiBs, if set, aborts transfers from mirrors that send less than this amount of data during
+	// ThroughputWindow, and evicts the mirror. Transfers aborted before anything is sent to the client are retried
+	// on a different mirror, while for the rest the client connection is aborted. This catches mirrors trickling data
+	// just fast enough to avoid timeouts.
+	MinThroughputMiBs float64 `yaml:"minThroughputMiBs"`
+	// ThroughputWindow is the period over which MinThroughputMiBs is checked. Defaults to 10s.
+	ThroughputWindow time.Duration `yaml:"throughputWindow"`
+
+	// FlushInterval controls how often the response is flushed to the client while it is being copied, so
+	// intermediate proxies do not buffer it indefinitely. Data is flushed at most an interval after being written, even
+	// if the mirror stalls. Zero disables periodic flushing, and a negative value flushes after every write.
+	FlushInterval time.Duration `yaml:"flushInterval"`
+
+	// ForwardTrailers controls whether HTTP trailers sent by mirrors are forwarded to the client.
+	ForwardTrailers bool `yaml:"forwardTrailers"`
+	// VerifyTrailers enables validation of the Content-Digest trailer, if a mirror sends one. As the body has already
+	// been sent when trailers are received, a mismatch aborts the connection so the client gets a truncated response.
+	VerifyTrailers bool `yaml:"verifyTrailers"`
+
+	// VerifyContentRange checks that partial responses sent by mirrors cover exactly the range requested by the
+	// client, retrying on a different mirror otherwise. This prevents clients resuming a download from appending the
+	// wrong bytes to it.
+	VerifyContentRange bool `yaml:"verifyContentRange"`
+
+	// VerifyDigests checks bodies against the digest announced by mirrors in the Content-Digest, Digest or
+	// Content-MD5 headers, if any, and evicts mirrors sending corrupt files. Bodies that fit in the peek are verified
+	// before being sent, and retried on a different mirror on mismatch. Larger ones can only be verified once sent, so
+	// the connection is aborted on mismatch.
+	VerifyDigests bool `yaml:"verifyDigests"`
+
+	// Statuses controls whether responses from mirrors are passed to the client, retried or failed, depending on
+	// their status code.
+	Statuses StatusPolicy `yaml:"statuses"`
+
+	// IsRetryable is called when an attempt fails before anything has been written to the client, either because the
+	// mirror could not be reached, in which case response is nil, because it returned a status that should be retried,
+	// in which case err is a StatusError, or because the body could not be read. If it returns false, the request is
+	// not retried: the response of the mirror is passed to the client for a StatusError, and otherwise the request is
+	// answered with 502 Bad Gateway. Defaults to DefaultIsRetryable.
+	IsRetryable func(err error, response *http.Response) bool `yaml:"-"`
+
+	// NormalizePaths cleans request paths before matching rules and requesting them from mirrors, collapsing
+	// duplicate slashes, resolving dot segments and removing trailing slashes. Query strings are never sent to
+	// mirrors.
+	NormalizePaths bool `yaml:"normalizePaths"`
+
+	// DebugHeaders adds diagnostic headers, like the number of retries a request needed, to responses sent to clients.
+	DebugHeaders bool `yaml:"debugHeaders"`
+
+	// MaxClientDownloads is the maximum number of requests a single client, identified by its IP address, can have in
+	// progress at the same time. Requests over the limit are answered with 429 Too Many Requests. Zero disables the
+	// limit.
+	MaxClientDownloads int `yaml:"maxClientDownloads"`
+	// ClientIPHeader is the name of a header, like X-Forwarded-For, from which the client IP address is read when
+	// refractor runs behind a trusted proxy. If empty or not present, the address of the connection is used.
+	ClientIPHeader string `yaml:"clientIPHeader"`
+
+	// BandwidthLimits cap the throughput of downloads from certain mirrors. Limits must be compiled before creating
+	// the pool.
+	BandwidthLimits BandwidthLimits `yaml:"bandwidthLimits"`
+
+	// MaxMiBs, if set, caps the throughput of all downloads put together, so refractor does not saturate the uplink.
+	// It is applied as bodies are relayed to clients, after the peek, and the time spent waiting on it is not counted
+	// against mirrors.
+	MaxMiBs float64 `yaml:"maxMiBs"`
+	// ClientMiBs, if set, caps the throughput of the downloads of each client, identified by its IP address, so a
+	// single client cannot starve others. It is applied in the same way as MaxMiBs.
+	ClientMiBs float64 `yaml:"clientMiBs"`
+
+	// Fallback is the URL of a mirror of last resort, which is not part of the pool and only used when a request
+	// exhausts its retries. It is meant for slow but authoritative origins.
+	Fallback string `yaml:"fallback"`
+
+	// EgressCapGiBs, if set, is the maximum amount of data downloaded from mirrors during EgressPeriod. Once it is
+	// reached, new requests are answered with 503 Service Unavailable until the period ends. Downloads in progress are
+	// not interrupted, so the cap may be slightly exceeded. Usage is not persisted across restarts.
+	EgressCapGiBs float64 `yaml:"egressCapGiBs"`
+	// EgressPeriod is the period after which usage counted towards EgressCapGiBs is reset. Defaults to 30 days.
+	EgressPeriod time.Duration `yaml:"egressPeriod"`
+
+	// Cache, if set, stores files downloaded from mirrors, and serves further requests for them without contacting
+	// any mirror.
+	Cache Cache `yaml:"-"`
+	// CachePrefetch keeps downloading files that would be stored in the cache after the client requesting them goes
+	// away, so they are cached for the next one. Downloads being prefetched keep counting towards MaxClientDownloads
+	// for the client that started them, and are still throttled by MaxMiBs and ClientMiBs.
+	CachePrefetch bool `yaml:"cachePrefetch"`
+	// CacheBufferMiBs, if set, decouples sending files being cached to the client from writing them to the cache, by
+	// buffering up to this amount of data for the client. The transfer from the mirror, and the cache with it, can then
+	// get ahead of a slow client instead of being slowed down to its pace. Zero writes to both in lockstep.
+	CacheBufferMiBs float64 `yaml:"cacheBufferMiBs"`
+
+	// Audit is an optional sink where an AuditRecord is written as a JSON line after every request.
+	Audit io.Writer `yaml:"-"`
+
+	// Rules override how requests for certain paths are handled. Rules must be compiled before creating the pool, and
+	// can be replaced afterwards with SetRules.
+	Rules rules.Rules `yaml:"rules"`
 }
 
-func New(config Config, stats *stats.Stats) *Pool {
-	return &Pool{
-		Config:   config,
-		stats:    stats,
-		namer:    names.Haiku,
-		clients:  make(chan *client.Client),
-		requests: make(chan client.Request),
+func New(config Config, clientConfig client.Config, stats *stats.Stats, m metrics.Metrics) *Pool {
+	p := &Pool{
+		Config:       config,
+		clientConfig: clientConfig,
+		stats:        stats,
+		metrics:      m,
+		namer:        names.Haiku,
+		clients:      make(chan *client.Client),
+		requests:     make(chan client.Request),
+		workers:      map[string]worker.Worker{},
+		throttles:    throttles{limits: config.BandwidthLimits},
+		throttle:     newLimiter(config.MaxMiBs),
+		limiter:      clientLimiter{mibs: config.ClientMiBs},
+		egress:       newEgress(config.EgressCapGiBs, config.EgressPeriod),
 		peeker: peeker.Peeker{
 			SizeBytes: config.PeekSizeMiBs * 1024 * 1024,
 			Timeout:   config.PeekTimeout,
 		},
 	}
+
+	if config.Fallback != "" {
+		p.fallback = client.NewClient(clientConfig, config.Fallback)
+	}
+
+	p.SetRules(config.Rules)
+
+	return p
 }
 
 func (p *Pool) Feed(provider types.Provider) {
+	if dp, ok := provider.(types.DrainingProvider); ok {
+		dp.SetDrainer(p)
+	}
+
 	log.Infof("Starting to feed mirrors to the pool")
 	for {
 		url, err := provider.Mirror()
 		if err != nil {
-			log.Errorf("Provided returned an error: %v", err)
+			log.Errorf("Provider returned an error: %v", err)
 			time.Sleep(10 * time.Second)
+			continue
 		}
-		p.clients <- client.NewClient(client.Config{}, url)
+
+		if p.cooldowns.active(url) {
+			log.Debugf("Not feeding %s to the pool, as it was evicted recently", url)
+			// Providers with few mirrors may keep returning the same ones, so avoid spinning.
+			time.Sleep(time.Second)
+			continue
+		}
+
+		p.clients <- client.NewClient(p.clientConfig, url)
 	}
 }
 
@@ -76,98 +254,972 @@ func (p *Pool) Run() {
 
 func (p *Pool) work() {
 	for cli := range p.clients {
-		worker := worker.Worker{
+		w := worker.Worker{
 			Client: cli,
 			Stats:  p.stats,
 			Name:   p.namer(),
 		}
-		log.Error(worker.Work(p.requests))
-		p.stats.Remove(worker.String())
+		p.metrics.SetGauge(metrics.Workers, float64(atomic.AddInt64(&p.activeWorkers, 1)), nil)
+		p.addWorker(w)
+		log.WithFields(log.Fields{"worker": w.Name, "mirror": cli.String()}).Info("Mirror joined the pool")
+
+		started := time.Now()
+		err := w.Work(p.requests)
+		p.stats.Remove(w.String())
+		if !p.removeWorker(w) {
+			// Limiters are kept only for mirrors in the pool, rather than for every mirror ever seen.
+			p.throttles.forget(cli.String())
+		}
+		// Evicted clients are not reused, so their connections would otherwise linger until they time out.
+		cli.Close()
+
+		reason := "error"
+		if errors.Is(err, worker.ErrPoorPerformer) {
+			reason = "performance"
+		}
+
+		log.WithFields(log.Fields{
+			"worker":   w.Name,
+			"mirror":   cli.String(),
+			"reason":   reason,
+			"lifetime": time.Since(started).Round(time.Second).String(),
+		}).Warnf("Mirror evicted from the pool: %v", err)
+
+		if p.MirrorCooldown > 0 {
+			p.cooldowns.start(cli.String(), p.MirrorCooldown)
+		}
+
+		p.metrics.IncCounter(metrics.Evictions, metrics.Labels{metrics.LabelReason: reason})
+		p.metrics.SetGauge(metrics.Workers, float64(atomic.AddInt64(&p.activeWorkers, -1)), nil)
+	}
+}
+
+func (p *Pool) addWorker(w worker.Worker) {
+	p.workersMtx.Lock()
+	defer p.workersMtx.Unlock()
+
+	p.workers[w.String()] = w
+}
+
+// removeWorker takes w out of the pool, and returns whether other workers are still assigned to its mirror.
+func (p *Pool) removeWorker(w worker.Worker) bool {
+	p.workersMtx.Lock()
+	defer p.workersMtx.Unlock()
+
+	delete(p.workers, w.String())
+	for _, other := range p.workers {
+		if other.Client.String() == w.Client.String() {
+			return true
+		}
+	}
+
+	return false
+}
+
+// excludedWorkers returns the workers still in the pool that have been asked for dl, once each. It returns nil if all
+// of them have, as there is no other worker to leave the request to.
+func (p *Pool) excludedWorkers(dl *download) []string {
+	tried := dl.triedWorkers()
+
+	p.workersMtx.Lock()
+	defer p.workersMtx.Unlock()
+
+	exclude := make([]string, 0, len(tried))
+	seen := map[string]bool{}
+	for _, name := range tried {
+		if _, inPool := p.workers[name]; !inPool || seen[name] {
+			continue
+		}
+
+		seen[name] = true
+		exclude = append(exclude, name)
+	}
+
+	if len(exclude) == 0 || len(exclude) >= len(p.workers) {
+		return nil
+	}
+
+	return exclude
+}
+
+// Mirrors returns the URLs of the mirrors currently assigned to a worker.
+func (p *Pool) Mirrors() []string {
+	p.workersMtx.Lock()
+	defer p.workersMtx.Unlock()
+
+	mirrors := make([]string, 0, len(p.workers))
+	for _, w := range p.workers {
+		mirrors = append(mirrors, w.Client.String())
+	}
+
+	sort.Strings(mirrors)
+	return mirrors
+}
+
+// Ranking returns the current ranking of workers, as computed by stats.Stats, along with the amount of downloads in
+// progress from their mirrors.
+func (p *Pool) Ranking() []stats.Rank {
+	ranking := p.stats.Ranking()
+
+	p.workersMtx.Lock()
+	defer p.workersMtx.Unlock()
+
+	for i := range ranking {
+		if w, found := p.workers[ranking[i].Worker]; found {
+			ranking[i].Downloads = p.mirrorDownloads.get(w.Client.String())
+		}
+	}
+
+	return ranking
+}
+
+// Reset clears the throughput measured for all workers, so they are ranked from scratch. This is useful when
+// network conditions change and past measurements are no longer representative.
+func (p *Pool) Reset() {
+	log.Infof("Resetting worker stats")
+	p.stats.Reset()
+}
+
+// Downloads returns the progress of the requests currently being served, oldest first.
+func (p *Pool) Downloads() []Download {
+	return p.downloads.list()
+}
+
+// Status summarizes the state of the pool.
+type Status struct {
+	Workers   int `json:"workers"`
+	Downloads int `json:"downloads"`
+	// EgressBytes is the amount of data downloaded from mirrors during the current egress period.
+	EgressBytes int64 `json:"egressBytes"`
+	// CacheBytes is the size of the files in the cache, if enabled.
+	CacheBytes int64 `json:"cacheBytes,omitempty"`
+	// RecentErrors lists the last requests that failed, oldest first.
+	RecentErrors []AuditRecord `json:"recentErrors"`
+}
+
+// Status returns a summary of the state of the pool.
+func (p *Pool) Status() Status {
+	status := Status{
+		Workers:      int(atomic.LoadInt64(&p.activeWorkers)),
+		Downloads:    int(atomic.LoadInt64(&p.activeDownloads)),
+		EgressBytes:  p.egress.usage(),
+		RecentErrors: p.recentErrors.list(),
+	}
+
+	if p.Cache != nil {
+		status.CacheBytes = p.Cache.Size()
+	}
+
+	return status
+}
+
+// DrainMirror marks the workers assigned to mirror for eviction, which happens as soon as they are given their next
+// request. Downloads they are already serving are not interrupted. It returns false if mirror is not in the pool.
+func (p *Pool) DrainMirror(mirror string) bool {
+	p.workersMtx.Lock()
+	defer p.workersMtx.Unlock()
+
+	found := false
+	for name, w := range p.workers {
+		if w.Client.String() == mirror {
+			log.Infof("Draining worker %s", name)
+			p.stats.Evict(name)
+			found = true
+		}
 	}
+
+	return found
+}
+
+// CancelDownload aborts the download with the given ID, as reported by Downloads, including any transfer from a mirror
+// in progress. It returns false if no such download is in progress.
+func (p *Pool) CancelDownload(id string) bool {
+	log.Infof("Canceling download %s", id)
+	return p.downloads.cancel(id)
 }
 
 func (p *Pool) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	p.serveHTTP(rw, r, nil)
+}
+
+// serveHTTP serves r as ServeHTTP does. If finished is not nil and r is served from mirrors, it is called with the
+// error that made the download fail, or nil if it succeeded, once the download is over.
+func (p *Pool) serveHTTP(rw http.ResponseWriter, r *http.Request, finished func(error)) {
+	if p.NormalizePaths {
+		r = r.Clone(r.Context())
+		r.URL.Path = path.Clean("/" + r.URL.Path)
+		r.URL.RawPath = ""
+	}
+
+	// Requests keep using the rules they started with, even if they are replaced in the meantime.
+	rs := p.currentRules()
+	class := rs.rules.Class(r.URL.Path)
+	if rule := rs.rules.Match(r.URL.Path); rule != nil {
+		log.Debugf("Answering %s with status %d as per rules", r.URL.Path, rule.Status)
+		started := time.Now()
+		lw := &localWriter{ResponseWriter: rw}
+		lw.WriteHeader(rule.Status)
+		_, _ = lw.Write([]byte(rule.Body))
+		p.auditLocal(r.URL.Path, class, "rule", started, lw)
+		return
+	}
+
+	if p.serveCached(rw, r, class) {
+		return
+	}
+
+	ip := clientIP(r, p.ClientIPHeader)
+	if !p.limiter.acquire(ip, p.MaxClientDownloads) {
+		log.Warnf("Rejecting %s from %s, which already has %d requests in progress", r.URL.Path, ip, p.MaxClientDownloads)
+		p.countRequest("limited", class)
+		rw.WriteHeader(http.StatusTooManyRequests)
+		return
+	}
+	defer p.limiter.release(ip)
+
+	if capped, remaining := p.egress.exceeded(); capped {
+		log.Warnf("Rejecting %s, as the egress cap of %.2f GiB has been reached", r.URL.Path, p.EgressCapGiBs)
+		p.countRequest("capped", class)
+		rw.Header().Set("Retry-After", strconv.Itoa(int(remaining.Seconds())+1))
+		rw.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	// Deriving from the request context cancels attempts in progress, including the transfer from the mirror, if the
+	// client goes away. Files being prefetched into the cache are downloaded in full regardless.
+	reqCtx := r.Context()
+	if p.CachePrefetch && p.caches(r) {
+		reqCtx = detachedContext{Context: reqCtx}
+	}
+	ctx, cancel := context.WithCancel(reqCtx)
+	defer cancel()
+
+	dl := p.downloads.start(r.URL.Path, class, cancel)
+	rw = statusWriter{ResponseWriter: rw, dl: dl}
+	for _, limiter := range []*rate.Limiter{p.throttle, p.limiter.limiter(ip)} {
+		if limiter != nil {
+			dl.limiters = append(dl.limiters, limiter)
+		}
+	}
+	p.metrics.SetGauge(metrics.Downloads, float64(atomic.AddInt64(&p.activeDownloads, 1)), nil)
+	defer func() {
+		p.downloads.finish(dl)
+		p.metrics.SetGauge(metrics.Downloads, float64(atomic.AddInt64(&p.activeDownloads, -1)), nil)
+		record := dl.auditRecord()
+		p.recentErrors.add(record)
+		p.audit(record)
+		if finished != nil {
+			finished(dl.failure())
+		}
+	}()
+
+	logger := dl.logger()
+	if p.DebugHeaders {
+		rw.Header().Set(downloadHeader, dl.id)
+	}
+
+	policy := p.policy(rs.rules, r.URL.Path)
+	if policy.requestTimeout > 0 {
+		var cancelTimeout context.CancelFunc
+		ctx, cancelTimeout = context.WithTimeout(ctx, policy.requestTimeout)
+		defer cancelTimeout()
+	}
+
+	pinned := rs.pinned[rs.rules.Mirror(r.URL.Path)]
+
+	// Wrapping rw after the checks above keeps rejected requests out of the cache. Stale copies are sent through
+	// uncached, as they come from the cache already.
+	uncached := rw
+	cw := p.cachingWriter(rw, r, logger)
+	if cw != nil {
+		defer cw.discard()
+		rw = cw
+	}
+	// upstream is the request sent to mirrors, which is conditional if the cached copy has to be revalidated.
+	upstream := p.revalidation(r, cw)
+
 	retries := 0
+	var lastErr error
 	for {
-		if retries > p.Config.Retries {
-			log.Errorf("Max retries for %s exhausted", r.URL.Path)
-			rw.WriteHeader(http.StatusInternalServerError)
+		if dl.wasCanceled() {
+			logger.Warnf("Request for %s was canceled", r.URL.Path)
+			p.countRequest("canceled", class)
+			dl.result(retries, ctx.Err())
+			rw.WriteHeader(http.StatusServiceUnavailable)
 			return
 		}
 
-		err, retryable := p.tryRequest(r, rw)
+		if reqCtx.Err() != nil {
+			logger.Warnf("Client went away while requesting %s", r.URL.Path)
+			p.countRequest("aborted", class)
+			dl.result(retries, reqCtx.Err())
+			return
+		}
+
+		if ctx.Err() != nil {
+			logger.Errorf("Request for %s timed out after %v", r.URL.Path, policy.requestTimeout)
+			p.countRequest("timeout", class)
+			dl.result(retries, ctx.Err())
+			rw.WriteHeader(http.StatusGatewayTimeout)
+			return
+		}
+
+		if retries > policy.retries {
+			if p.fallback != nil {
+				logger.Warnf("Max retries for %s exhausted, trying fallback mirror", r.URL.Path)
+				err, retryable := p.tryFallback(ctx, upstream, rw, dl)
+				if err == nil && cw.revalidated() {
+					if p.serveRevalidated(uncached, r, logger) {
+						dl.servedFrom("cache")
+						p.countRequest("revalidated", class)
+						dl.result(retries-1, nil)
+						return
+					}
+
+					err, retryable = fmt.Errorf("%s was removed from the cache while being revalidated", r.URL.Path), true
+				}
+
+				if err == nil {
+					if clientErr := cw.commit(); clientErr != nil {
+						logger.Warnf("Client went away: %v", clientErr)
+						p.countRequest("aborted", class)
+						dl.result(retries-1, clientErr)
+						return
+					}
+
+					p.countRequest("fallback", class)
+					dl.result(retries-1, nil)
+					return
+				}
+
+				logger.Errorf("%v", err)
+				if !retryable {
+					p.countRequest("error", class)
+					dl.result(retries-1, err)
+					return
+				}
+				lastErr = err
+			}
+
+			if p.serveStale(uncached, r, logger) {
+				dl.servedFrom("cache")
+				p.countRequest("stale", class)
+				dl.result(retries-1, nil)
+				return
+			}
+
+			logger.Errorf("Max retries for %s exhausted", r.URL.Path)
+			p.countRequest("exhausted", class)
+			dl.result(retries-1, errors.New("max retries exhausted"))
+			status := http.StatusInternalServerError
+			if errors.Is(lastErr, errMirrorFailed) {
+				// Tell clients the mirrors could not be reached at all, rather than answering badly.
+				status = http.StatusBadGateway
+			}
+			rw.WriteHeader(status)
+			return
+		}
+
+		if p.DebugHeaders {
+			rw.Header().Set(retriesHeader, strconv.Itoa(retries))
+		}
+
+		var err error
+		var retryable bool
+		if pinned != nil {
+			err, retryable = p.tryPinned(ctx, pinned, upstream, rw, dl)
+		} else {
+			err, retryable = p.tryRequest(ctx, upstream, rw, dl)
+		}
+		lastErr = err
+		if err == nil && cw.revalidated() {
+			if p.serveRevalidated(uncached, r, logger) {
+				dl.servedFrom("cache")
+				p.countRequest("revalidated", class)
+				dl.result(retries, nil)
+				return
+			}
+
+			logger.Warnf("%s was removed from the cache while being revalidated, downloading it again", r.URL.Path)
+			cw.stopRevalidating()
+			upstream = r
+			continue
+		}
+
 		if err == nil {
+			if clientErr := cw.commit(); clientErr != nil {
+				logger.Warnf("Client went away: %v", clientErr)
+				p.countRequest("aborted", class)
+				dl.result(retries, clientErr)
+				return
+			}
+
+			result := "ok"
+			if cw.prefetched() {
+				result = "prefetched"
+			}
+			p.countRequest(result, class)
+			dl.result(retries, nil)
 			return
 		}
 
-		log.Errorf("%v", err)
+		if errors.Is(err, errClientWrite) || reqCtx.Err() != nil {
+			logger.Warnf("Client went away: %v", err)
+			p.countRequest("aborted", class)
+			dl.result(retries, err)
+			return
+		}
+
+		if !retryable && dl.wasCanceled() {
+			// Part of the body may have been sent already, so the connection is aborted to let the client know the
+			// response is incomplete.
+			logger.Warnf("Aborting canceled response for %s: %v", r.URL.Path, err)
+			p.countRequest("canceled", class)
+			dl.result(retries, err)
+			panic(http.ErrAbortHandler)
+		}
+
+		logger.Errorf("%v", err)
+		if !retryable && errors.Is(ctx.Err(), context.DeadlineExceeded) && dl.wroteBody() {
+			// As with cancellations, the connection is aborted so clients do not take what was sent for the whole body,
+			// which they could not tell otherwise if the mirror sent no Content-Length.
+			logger.Errorf("Aborting response for %s, which timed out after %v", r.URL.Path, policy.requestTimeout)
+			p.countRequest("timeout", class)
+			dl.result(retries, err)
+			panic(http.ErrAbortHandler)
+		}
+
 		if !retryable {
+			p.countRequest("error", class)
+			dl.result(retries, err)
+			switch {
+			case errors.Is(err, errDigestMismatch):
+				// The body has already been sent, so the connection is aborted to at least let the client know the
+				// response is incomplete rather than have it accept corrupt data.
+				logger.Errorf("Aborting response for %s with corrupt body", r.URL.Path)
+				panic(http.ErrAbortHandler)
+			case dl.wroteBody() && (errors.Is(err, errTooSlow) || errors.Is(err, io.ErrUnexpectedEOF)):
+				// Likewise for mirrors abandoned halfway through the body, whose end would otherwise look like the end
+				// of the file to clients if the mirror sent no Content-Length.
+				logger.Errorf("Aborting incomplete response for %s", r.URL.Path)
+				panic(http.ErrAbortHandler)
+			}
 			return
 		}
 
-		log.Warnf("Retrying %s", r.URL.Path)
+		if ctx.Err() != nil {
+			continue
+		}
+
+		logger.WithField("retries", retries).Warnf("Retrying %s", r.URL.Path)
+		p.metrics.IncCounter(metrics.Retries, nil)
 		retries++
+
+		if policy.retryBackoff > 0 {
+			select {
+			case <-time.After(retryDelay(policy.retryBackoff, retries)):
+			case <-ctx.Done():
+			}
+		}
 	}
 }
 
-func (p *Pool) tryRequest(r *http.Request, rw http.ResponseWriter) (error, bool) {
+// retryPolicy controls how many times and for how long a request is retried.
+type retryPolicy struct {
+	retries        int
+	requestTimeout time.Duration
+	retryBackoff   time.Duration
+}
+
+// policy returns the retry policy for path, which is the one in the pool config overridden by rs.
+func (p *Pool) policy(rs rules.Rules, path string) retryPolicy {
+	policy := retryPolicy{
+		retries:        p.Config.Retries,
+		requestTimeout: p.RequestTimeout,
+		retryBackoff:   p.RetryBackoff,
+	}
+
+	override := rs.Policy(path)
+	if override.Retries != nil {
+		policy.retries = *override.Retries
+	}
+	if override.RequestTimeout != nil {
+		policy.requestTimeout = *override.RequestTimeout
+	}
+	if override.RetryBackoff != nil {
+		policy.retryBackoff = *override.RetryBackoff
+	}
+
+	return policy
+}
+
+func (p *Pool) tryRequest(ctx context.Context, r *http.Request, rw http.ResponseWriter, dl *download) (error, bool) {
+	// Workers that already failed to serve the request leave it to others, unless all of them did.
+	exclude := p.excludedWorkers(dl)
+
 	responseChan := make(chan client.Response)
 	request := client.Request{
+		Method:       upstreamMethod(r),
 		Path:         r.URL.Path,
 		ResponseChan: responseChan,
 		Header:       r.Header,
+		Context:      ctx,
+		Exclude:      exclude,
+		ID:           dl.id,
+	}
+
+	dl.logger().Debugf("Dispatching request %s to workers", request.Path)
+	select {
+	case p.requests <- request:
+	case <-ctx.Done():
+		return fmt.Errorf("waiting for a worker for %s: %w", request.Path, ctx.Err()), true
 	}
 
-	log.Debugf("Dispatching request %s to workers", request.Path)
-	p.requests <- request
+	// Workers answer requests whose context is done instead of requeuing them, so this returns soon after the deadline.
 	response := <-responseChan
+	dl.try(response.Worker)
+
+	err, retryable := p.serve(ctx, request, response, rw, dl)
+	p.countAttempt(response.Mirror, err)
+
+	return err, retryable
+}
+
+// serve writes the response obtained from a mirror to the client. It returns an error if the response could not be
+// served, and whether the request can be retried.
+func (p *Pool) serve(ctx context.Context, request client.Request, response client.Response, rw http.ResponseWriter, dl *download) (error, bool) {
+	logger := dl.attemptLogger(response.Mirror)
+
 	if response.Error != nil {
-		return fmt.Errorf("%s%s errored: %w", response.Worker, request.Path, response.Error), true
+		err := fmt.Errorf("%s%s %w: %v", response.Worker, request.Path, errMirrorFailed, response.Error)
+		if !p.isRetryable(err, nil) {
+			rw.WriteHeader(http.StatusBadGateway)
+			return err, false
+		}
+
+		return err, true
+	}
+
+	// Closing the body aborts the attempt if it is still transferring, e.g. after a peek timeout, so it does not
+	// keep consuming bandwidth while the request is retried elsewhere.
+	defer response.HTTPResponse.Body.Close()
+
+	egressed := &egressBody{ReadCloser: response.HTTPResponse.Body, egress: p.egress}
+	response.HTTPResponse.Body = egressed
+	defer func() {
+		labels := metrics.Labels{metrics.LabelMirror: response.Mirror}
+		p.metrics.ObserveHistogram(metrics.UpstreamBytes, float64(atomic.LoadInt64(&egressed.read)), labels)
+		p.metrics.SetGauge(metrics.EgressBytes, float64(p.egress.usage()), nil)
+	}()
+
+	switch p.Statuses.action(response.HTTPResponse.StatusCode) {
+	case statusEvict:
+		logger.Warnf("%s returned %d for %s, evicting", response.Mirror, response.HTTPResponse.StatusCode, request.Path)
+		p.stats.Evict(response.Worker)
+		fallthrough
+	case statusRetry:
+		status := response.HTTPResponse.StatusCode
+		err := fmt.Errorf("%s%s returned %w", response.Worker, request.Path, StatusError{Status: status, Listed: p.Statuses.listed(status)})
+		if p.isRetryable(err, response.HTTPResponse) {
+			return err, true
+		}
+
+		// Statuses that are not worth retrying, like a 404 for a missing file or a 416 for a client resuming a complete
+		// download, are meaningful to the client, so they are passed through.
+		logger.Debugf("Passing status %d for %s to the client, as it is not retryable", status, request.Path)
+	case statusFail:
+		rw.WriteHeader(http.StatusBadGateway)
+		return fmt.Errorf("%s%s returned failing status: %d", response.Worker, request.Path, response.HTTPResponse.StatusCode), false
+	}
+
+	if p.VerifyContentRange && response.HTTPResponse.StatusCode == http.StatusPartialContent {
+		err := checkContentRange(request.Header.Get("Range"), response.HTTPResponse.Header.Get("Content-Range"))
+		if err != nil {
+			err = fmt.Errorf("%s%s: %w", response.Worker, request.Path, err)
+			if !p.isRetryable(err, response.HTTPResponse) {
+				rw.WriteHeader(http.StatusBadGateway)
+				return err, false
+			}
+
+			return err, true
+		}
+	}
+
+	dl.attempt(response.Mirror, response.HTTPResponse)
+	mirrorLabels := metrics.Labels{metrics.LabelMirror: response.Mirror}
+	p.metrics.SetGauge(metrics.MirrorDownloads, float64(p.mirrorDownloads.add(response.Mirror, 1)), mirrorLabels)
+	defer func() {
+		p.metrics.SetGauge(metrics.MirrorDownloads, float64(p.mirrorDownloads.add(response.Mirror, -1)), mirrorLabels)
+	}()
+	// Time spent waiting on bandwidth limits is not held against the mirror.
+	throttled := &throttleClock{}
+	response.HTTPResponse.Body = watchBody(response.HTTPResponse.Body, p.MinThroughputMiBs, p.ThroughputWindow, throttled)
+	response.HTTPResponse.Body = p.throttles.body(ctx, response.Mirror, response.HTTPResponse.Body, throttled)
+
+	start := time.Now()
+	// Peek body before writing headers, so failures up to this point can still be retried or answered with a 502.
+	peeked, err := p.peeker.Peek(response.HTTPResponse.Body)
+	if err != nil {
+		// The mirror dropped the connection early or is too slow, but as nothing has been sent yet the request can
+		// still be served by a different one.
+		switch {
+		case errors.Is(err, io.ErrUnexpectedEOF):
+			p.evictTruncated(logger, response, request.Path, int64(len(peeked)))
+		case errors.Is(err, errTooSlow):
+			p.evictSlow(logger, response, request.Path)
+		}
+
+		// Cancellations, by the client going away or through the admin API, say nothing about the mirror.
+		if !errors.Is(err, context.Canceled) {
+			response.Done(0, throttled.total())
+		}
+
+		err = fmt.Errorf("peeking %s%s: %w", response.Worker, request.Path, err)
+		if !p.isRetryable(err, response.HTTPResponse) {
+			rw.WriteHeader(http.StatusBadGateway)
+			return err, false
+		}
+
+		return err, true
 	}
 
-	if response.HTTPResponse.StatusCode >= 400 {
-		// TODO: Hack: Archlinux mirrors are somehow expected to return 404 for .sig files.
-		// For this reason, we do not attempt to retry 404s for .sig files.
-		if !strings.HasSuffix(r.URL.Path, ".db.sig") {
-			return fmt.Errorf("%s%s returned non-200 status: %d", response.Worker, request.Path, response.HTTPResponse.StatusCode), true
+	var announced *bodyDigest
+	if p.VerifyDigests && response.HTTPResponse.StatusCode == http.StatusOK && request.Method != http.MethodHead {
+		announced, err = announcedDigest(response.HTTPResponse.Header)
+		if err != nil {
+			logger.Warnf("Ignoring digest announced by %s for %s: %v", response.Mirror, request.Path, err)
 		}
 	}
 
-	written, err := p.writeResponse(response.HTTPResponse, rw)
-	response.Done(written)
+	if announced != nil {
+		_, _ = announced.Write(peeked)
+		// Bodies that fit entirely in the peek can be verified before anything is sent, so they can still be retried.
+		if int64(len(peeked)) == response.HTTPResponse.ContentLength {
+			err = announced.Verify()
+			if err != nil {
+				p.evictCorrupt(logger, response, request.Path, err)
+				err = fmt.Errorf("verifying %s%s: %w", response.Worker, request.Path, err)
+				if !p.isRetryable(err, response.HTTPResponse) {
+					rw.WriteHeader(http.StatusBadGateway)
+					return err, false
+				}
+
+				return err, true
+			}
+
+			announced = nil
+		}
+	}
+
+	labels := metrics.Labels{metrics.LabelMirror: response.Mirror, metrics.LabelClass: dl.class}
+	p.metrics.ObserveHistogram(metrics.TimeToFirstByte, time.Since(dl.started).Seconds(), labels)
+
+	written, err := p.writeResponse(ctx, response.HTTPResponse, peeked, announced, rw, dl, throttled, logger)
+	if errors.Is(err, errClientWrite) {
+		// Part of the body may have reached the client already and cannot be taken back, so the download is aborted
+		// rather than retried. The mirror is not to blame, so it is neither evicted nor sampled. Returning closes the
+		// body, which cancels the transfer from the mirror.
+		p.metrics.IncCounter(metrics.ClientWriteFailures, metrics.Labels{metrics.LabelMirror: response.Mirror})
+		return fmt.Errorf("aborting %s%s after %d bytes: %w", response.Worker, request.Path, written, err), false
+	}
+
+	// HEAD and 304 Not Modified responses carry no body, so they say nothing about the throughput of the mirror.
+	if request.Method != http.MethodHead && response.HTTPResponse.StatusCode != http.StatusNotModified {
+		response.Done(written, throttled.total())
+	}
+
+	p.metrics.ObserveHistogram(metrics.ResponseBytes, float64(written), labels)
+	p.metrics.ObserveHistogram(metrics.ResponseDuration, time.Since(start).Seconds(), labels)
+
+	switch {
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		p.evictTruncated(logger, response, request.Path, written)
+	case errors.Is(err, errTooSlow):
+		p.evictSlow(logger, response, request.Path)
+	case errors.Is(err, errDigestMismatch):
+		p.evictCorrupt(logger, response, request.Path, err)
+	}
 
 	if err != nil {
+		// Headers have already been sent at this point, so the client cannot be told about the failure.
 		err = fmt.Errorf("writing %s%s to client: %w", response.Worker, request.Path, err)
-		return err, written == 0
+		return err, written == 0 && p.isRetryable(err, response.HTTPResponse)
 	}
 
 	return nil, false
 }
 
-func (p *Pool) writeResponse(response *http.Response, rw http.ResponseWriter) (int64, error) {
-	// Peek body before writing headers
-	peeked, err := p.peeker.Peek(response.Body)
-	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
-		return 0, fmt.Errorf("peeking response body: %w", err)
+// countRequest increments the requests counter for a request of the given class that finished with result.
+func (p *Pool) countRequest(result, class string) {
+	p.metrics.IncCounter(metrics.Requests, metrics.Labels{metrics.LabelResult: result, metrics.LabelClass: class})
+}
+
+// countAttempt increments the attempts counter for mirror, according to err. Failures caused by the client or by
+// cancellations are not the fault of the mirror and are not counted.
+func (p *Pool) countAttempt(mirror string, err error) {
+	result := "ok"
+	switch {
+	case errors.Is(err, errClientWrite), errors.Is(err, context.Canceled):
+		return
+	case err != nil:
+		result = "error"
 	}
 
+	p.metrics.IncCounter(metrics.Attempts, metrics.Labels{metrics.LabelMirror: mirror, metrics.LabelResult: result})
+}
+
+// upstreamMethod returns the method used to request r from mirrors. HEAD requests are forwarded as such, so no body
+// is downloaded, while anything else is fetched with GET.
+func upstreamMethod(r *http.Request) string {
+	if r.Method == http.MethodHead {
+		return http.MethodHead
+	}
+
+	return http.MethodGet
+}
+
+// evictTruncated takes the mirror that sent response out of the pool, as a short body strongly suggests a
+// misbehaving mirror.
+func (p *Pool) evictTruncated(logger *log.Entry, response client.Response, path string, received int64) {
+	logger.Warnf("%s sent %d out of %d bytes for %s, evicting", response.Mirror, received, response.HTTPResponse.ContentLength, path)
+	p.metrics.IncCounter(metrics.TruncatedResponses, metrics.Labels{metrics.LabelMirror: response.Mirror})
+	p.stats.Evict(response.Worker)
+}
+
+// evictSlow takes the mirror that sent response out of the pool, as it is sending data slower than the configured
+// minimum throughput.
+func (p *Pool) evictSlow(logger *log.Entry, response client.Response, path string) {
+	logger.Warnf("%s is sending %s slower than %.2f MiB/s, evicting", response.Mirror, path, p.MinThroughputMiBs)
+	p.stats.Evict(response.Worker)
+}
+
+// evictCorrupt takes the mirror that sent response out of the pool, as its body does not match its digest.
+func (p *Pool) evictCorrupt(logger *log.Entry, response client.Response, path string, err error) {
+	logger.Warnf("%s sent a corrupt body for %s (%v), evicting", response.Mirror, path, err)
+	p.stats.Evict(response.Worker)
+}
+
+// writeResponse sends response to the client, starting with the bytes already peeked from its body. If announced is
+// not nil, the rest of the body is checked against it. The body is throttled by the limiters of dl, and the time spent
+// waiting on them is added to throttled. Warnings are logged to logger.
+func (p *Pool) writeResponse(ctx context.Context, response *http.Response, peeked []byte, announced *bodyDigest, rw http.ResponseWriter, dl *download, throttled *throttleClock, logger *log.Entry) (int64, error) {
 	for header, values := range response.Header {
 		for _, value := range values {
 			rw.Header().Add(header, value)
 		}
 	}
 
+	var body io.Writer = clientWriter{Writer: rw}
+	var flushing *flushWriter
+	if flusher, ok := rw.(http.Flusher); ok && p.FlushInterval != 0 {
+		flushing = &flushWriter{Writer: body, flusher: flusher, interval: p.FlushInterval}
+		// Scheduled flushes must not happen once the handler is done with rw.
+		defer flushing.stop()
+		body = flushing
+	}
+
+	for _, limiter := range dl.limiters {
+		body = &throttledWriter{Writer: body, ctx: ctx, limiter: limiter, clock: throttled}
+	}
+
+	var digest digester
+	if _, declared := response.Trailer[contentDigestHeader]; declared && p.VerifyTrailers {
+		digest = newDigester()
+		body = io.MultiWriter(body, digest)
+	}
+
+	body = dl.writer(body)
+
+	// The last byte is held back until the body is verified, so clients never receive a complete but corrupt body.
+	var held *holdbackWriter
+	if announced != nil {
+		held = &holdbackWriter{Writer: body}
+		body = held
+	}
+
 	rw.WriteHeader(response.StatusCode)
-	peekedWritten, err := rw.Write(peeked)
+	peekedWritten, err := body.Write(peeked)
 	if err != nil {
 		return int64(peekedWritten), fmt.Errorf("writing peeked body: %w", err)
 	}
 
-	restWritten, err := io.Copy(rw, response.Body)
+	var rest io.Reader = response.Body
+	if announced != nil {
+		rest = io.TeeReader(rest, announced)
+	}
+
+	restWritten, err := io.Copy(body, rest)
 	written := int64(peekedWritten) + restWritten
 	if err != nil {
 		return written, fmt.Errorf("writing body: %w", err)
 	}
 
+	// Nor while trailers are being added to the headers.
+	flushing.stop()
+
+	// Trailers are only populated by net/http once the body has been read until EOF.
+	if p.ForwardTrailers {
+		for trailer, values := range response.Trailer {
+			for _, value := range values {
+				rw.Header().Add(http.TrailerPrefix+trailer, value)
+			}
+		}
+	}
+
+	if announced != nil {
+		err = announced.Verify()
+		if err != nil {
+			return written, fmt.Errorf("verifying body: %w", err)
+		}
+
+		err = held.flush()
+		if err != nil {
+			return written, fmt.Errorf("writing body: %w", err)
+		}
+	}
+
+	if digest != nil {
+		field := response.Trailer.Get(contentDigestHeader)
+		if field == "" {
+			logger.Warnf("%s trailer was announced but not sent", contentDigestHeader)
+			return written, nil
+		}
+
+		err = digest.Verify(field)
+		if errors.Is(err, errNoKnownDigest) {
+			logger.Warnf("%s trailer %q has no supported digest, not verifying it", contentDigestHeader, field)
+			return written, nil
+		}
+		if err != nil {
+			return written, fmt.Errorf("verifying %s trailer: %w", contentDigestHeader, err)
+		}
+	}
+
 	return written, nil
 }
+
+// errClientWrite is wrapped by errors returned when writing to the client fails, to tell them apart from errors
+// reading from the mirror.
+var errClientWrite = errors.New("writing to client")
+
+// clientWriter tags errors writing to the client with errClientWrite.
+type clientWriter struct {
+	io.Writer
+}
+
+func (cw clientWriter) Write(buf []byte) (int, error) {
+	n, err := cw.Writer.Write(buf)
+	if err != nil {
+		return n, fmt.Errorf("%w: %v", errClientWrite, err)
+	}
+
+	return n, nil
+}
+
+// holdbackWriter delays writing the last byte written to it until flush is called.
+type holdbackWriter struct {
+	io.Writer
+	last    [1]byte
+	holding bool
+}
+
+func (hw *holdbackWriter) Write(buf []byte) (int, error) {
+	if len(buf) == 0 {
+		return 0, nil
+	}
+
+	if hw.holding {
+		_, err := hw.Writer.Write(hw.last[:])
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := hw.Writer.Write(buf[:len(buf)-1])
+	if err != nil {
+		hw.holding = false
+		return n, err
+	}
+
+	hw.last[0] = buf[len(buf)-1]
+	hw.holding = true
+	return len(buf), nil
+}
+
+// flush writes the byte being held back, if any.
+func (hw *holdbackWriter) flush() error {
+	if !hw.holding {
+		return nil
+	}
+
+	hw.holding = false
+	_, err := hw.Writer.Write(hw.last[:])
+	return err
+}
+
+// flushWriter flushes the underlying http.Flusher after a write if more than interval has passed since the last flush.
+// Otherwise, a flush is scheduled for when interval is over, so bytes are not left buffered if the mirror stalls before
+// the next write.
+type flushWriter struct {
+	io.Writer
+	flusher  http.Flusher
+	interval time.Duration
+
+	mtx     sync.Mutex
+	last    time.Time
+	pending *time.Timer
+	stopped bool
+}
+
+func (fw *flushWriter) Write(buf []byte) (int, error) {
+	fw.mtx.Lock()
+	defer fw.mtx.Unlock()
+
+	n, err := fw.Writer.Write(buf)
+	if err != nil {
+		return n, err
+	}
+
+	if wait := fw.interval - time.Since(fw.last); wait > 0 {
+		if fw.pending == nil && !fw.stopped {
+			fw.pending = time.AfterFunc(wait, fw.scheduledFlush)
+		}
+		return n, nil
+	}
+
+	fw.flush()
+	return n, nil
+}
+
+func (fw *flushWriter) scheduledFlush() {
+	fw.mtx.Lock()
+	defer fw.mtx.Unlock()
+
+	fw.pending = nil
+	if !fw.stopped {
+		fw.flush()
+	}
+}
+
+// flush must be called with the mutex held.
+func (fw *flushWriter) flush() {
+	fw.flusher.Flush()
+	fw.last = time.Now()
+}
+
+// stop cancels any scheduled flush. Writes after stop only flush if interval has passed. It does nothing on a nil
+// flushWriter.
+func (fw *flushWriter) stop() {
+	if fw == nil {
+		return
+	}
+
+	fw.mtx.Lock()
+	defer fw.mtx.Unlock()
+
+	fw.stopped = true
+	if fw.pending != nil {
+		fw.pending.Stop()
+		fw.pending = nil
+	}
+}
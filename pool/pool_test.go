@@ -0,0 +1,2043 @@
+package pool_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"roob.re/refractor/cache"
+	"roob.re/refractor/client"
+	"roob.re/refractor/metrics"
+	"roob.re/refractor/pool"
+	"roob.re/refractor/pool/pooltest"
+	"roob.re/refractor/provider/types"
+	"roob.re/refractor/rules"
+	"roob.re/refractor/stats"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testPath = "/core/os/x86_64/core.db"
+
+var testFile = bytes.Repeat([]byte("lorem ipsum dolor sit amet "), 1024)
+
+// newServer starts a pool fed by provider and returns an HTTP server for it.
+func newServer(t *testing.T, config pool.Config, provider types.Provider) *httptest.Server {
+	t.Helper()
+
+	server := httptest.NewServer(newPool(t, config, provider))
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+// newPool starts a pool fed by provider, with test-friendly defaults.
+func newPool(t *testing.T, config pool.Config, provider types.Provider) *pool.Pool {
+	t.Helper()
+
+	if config.Workers == 0 {
+		config.Workers = 2
+	}
+	if config.Retries == 0 {
+		config.Retries = 3
+	}
+	if config.PeekSizeMiBs == 0 {
+		config.PeekSizeMiBs = 1
+	}
+	if config.PeekTimeout == 0 {
+		config.PeekTimeout = time.Second
+	}
+
+	p := pool.New(config, client.Config{}, stats.New(stats.Config{NumWorkers: config.Workers}), metrics.Nop{})
+	go p.Run()
+	go p.Feed(provider)
+
+	return p
+}
+
+func get(t *testing.T, url string) (*http.Response, []byte) {
+	t.Helper()
+
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("requesting %s: %v", url, err)
+	}
+
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("reading body: %v", err)
+	}
+
+	return resp, body
+}
+
+func TestPool_Serves_File(t *testing.T) {
+	t.Parallel()
+
+	mirror := pooltest.NewMirror(map[string][]byte{testPath: testFile})
+	t.Cleanup(mirror.Close)
+
+	server := newServer(t, pool.Config{}, pooltest.NewProvider(mirror))
+
+	resp, body := get(t, server.URL+testPath)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", resp.StatusCode)
+	}
+
+	if !bytes.Equal(body, testFile) {
+		t.Fatal("body does not match file")
+	}
+}
+
+func TestPool_Replaces_Dead_Mirror(t *testing.T) {
+	t.Parallel()
+
+	dead := pooltest.NewMirror(nil)
+	dead.Close()
+
+	good := pooltest.NewMirror(map[string][]byte{testPath: testFile})
+	t.Cleanup(good.Close)
+
+	server := newServer(t, pool.Config{}, pooltest.NewProvider(dead, good))
+
+	for i := 0; i < 4; i++ {
+		resp, body := get(t, server.URL+testPath)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", resp.StatusCode)
+		}
+
+		if !bytes.Equal(body, testFile) {
+			t.Fatal("body does not match file")
+		}
+	}
+}
+
+func TestPool_Fails_On_Dead_Mirrors(t *testing.T) {
+	t.Parallel()
+
+	dead := pooltest.NewMirror(nil)
+	dead.Close()
+
+	server := newServer(t, pool.Config{}, pooltest.NewProvider(dead))
+
+	resp, _ := get(t, server.URL+testPath)
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Fatalf("expected status %d, got %d", http.StatusBadGateway, resp.StatusCode)
+	}
+}
+
+func TestPool_Cancels_Timed_Out_Attempts(t *testing.T) {
+	t.Parallel()
+
+	mirror := pooltest.NewMirror(map[string][]byte{testPath: testFile})
+	mirror.SetBehavior(pooltest.Behavior{Stall: 10 * time.Second})
+	t.Cleanup(mirror.Close)
+
+	server := newServer(t, pool.Config{Retries: 1, PeekTimeout: 200 * time.Millisecond}, pooltest.NewProvider(mirror))
+
+	resp, _ := get(t, server.URL+testPath)
+	if resp.StatusCode == http.StatusOK {
+		t.Fatal("expected request to fail after peek timeouts")
+	}
+
+	if requests := mirror.Requests(); requests != 2 {
+		t.Fatalf("expected 2 attempts, mirror got %d", requests)
+	}
+
+	// Attempts that timed out should have been aborted, rather than left transferring in the background.
+	deadline := time.Now().Add(2 * time.Second)
+	for mirror.Active() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d attempts are still active", mirror.Active())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPool_Retries_On_Different_Worker(t *testing.T) {
+	t.Parallel()
+
+	failing := pooltest.NewMirror(map[string][]byte{testPath: testFile})
+	failing.SetBehavior(pooltest.Behavior{Status: http.StatusServiceUnavailable})
+	t.Cleanup(failing.Close)
+
+	busy := pooltest.NewMirror(map[string][]byte{testPath: testFile})
+	busy.SetBehavior(pooltest.Behavior{Latency: 300 * time.Millisecond})
+	t.Cleanup(busy.Close)
+
+	server := newServer(t, pool.Config{Retries: 1}, pooltest.NewProvider(failing, busy))
+
+	// Keep the working mirror busy, so the failing one is the only one idle when the next request is retried.
+	go func() {
+		resp, err := http.Get(server.URL + testPath)
+		if err == nil {
+			_, _ = io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	resp, body := get(t, server.URL+testPath)
+	if resp.StatusCode != http.StatusOK || !bytes.Equal(body, testFile) {
+		t.Fatalf("expected retry to wait for a different worker, got status %d", resp.StatusCode)
+	}
+}
+
+func TestPool_Times_Out_Requests(t *testing.T) {
+	t.Parallel()
+
+	mirror := pooltest.NewMirror(map[string][]byte{testPath: testFile})
+	mirror.SetBehavior(pooltest.Behavior{Latency: 10 * time.Second})
+	t.Cleanup(mirror.Close)
+
+	server := newServer(t, pool.Config{RequestTimeout: 200 * time.Millisecond}, pooltest.NewProvider(mirror))
+
+	start := time.Now()
+	resp, _ := get(t, server.URL+testPath)
+	if resp.StatusCode != http.StatusGatewayTimeout {
+		t.Fatalf("expected status 504, got %d", resp.StatusCode)
+	}
+
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("request took %v to time out", elapsed)
+	}
+
+	if requests := mirror.Requests(); requests != 1 {
+		t.Fatalf("expected timed out request not to be retried, mirror got %d requests", requests)
+	}
+}
+
+func TestPool_Aborts_Timed_Out_Transfers(t *testing.T) {
+	t.Parallel()
+
+	const size = 3 * 1024 * 1024
+	file := bytes.Repeat([]byte("refractor"), size/9)
+
+	mirror := pooltest.NewMirror(map[string][]byte{testPath: file})
+	// Without a Content-Length, clients can only tell the body is incomplete if the connection is aborted.
+	mirror.SetBehavior(pooltest.Behavior{Chunked: true, PauseAfter: size / 2, Stall: 10 * time.Second})
+	t.Cleanup(mirror.Close)
+
+	server := newServer(t, pool.Config{RequestTimeout: 500 * time.Millisecond}, pooltest.NewProvider(mirror))
+
+	resp, err := http.Get(server.URL + testPath)
+	if err != nil {
+		t.Fatalf("requesting file: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err == nil {
+		t.Fatalf("expected reading the timed out body to fail, got %d out of %d bytes", len(body), len(file))
+	}
+}
+
+func TestPool_Evicts_Truncating_Mirror(t *testing.T) {
+	t.Parallel()
+
+	// Larger than the peek size, so the connection is dropped after the response has been committed.
+	file := bytes.Repeat(testFile, 3*1024*1024/len(testFile))
+
+	truncating := pooltest.NewMirror(map[string][]byte{testPath: file})
+	truncating.SetBehavior(pooltest.Behavior{TruncateAfter: 2 * 1024 * 1024})
+	t.Cleanup(truncating.Close)
+
+	good := pooltest.NewMirror(map[string][]byte{testPath: file})
+	t.Cleanup(good.Close)
+
+	server := newServer(t, pool.Config{Workers: 1}, pooltest.NewProvider(truncating, good))
+
+	resp, err := http.Get(server.URL + testPath)
+	if err != nil {
+		t.Fatalf("requesting file: %v", err)
+	}
+
+	_, err = io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err == nil {
+		t.Fatal("expected truncated body to fail")
+	}
+
+	resp, body := get(t, server.URL+testPath)
+	if resp.StatusCode != http.StatusOK || !bytes.Equal(body, file) {
+		t.Fatal("expected file to be served by a different mirror")
+	}
+
+	if requests := good.Requests(); requests != 1 {
+		t.Fatalf("expected second request to be served by the good mirror, it got %d requests", requests)
+	}
+}
+
+func TestPool_Retries_Truncated_Peek(t *testing.T) {
+	t.Parallel()
+
+	truncating := pooltest.NewMirror(map[string][]byte{testPath: testFile})
+	truncating.SetBehavior(pooltest.Behavior{TruncateAfter: 1024})
+	t.Cleanup(truncating.Close)
+
+	good := pooltest.NewMirror(map[string][]byte{testPath: testFile})
+	t.Cleanup(good.Close)
+
+	server := newServer(t, pool.Config{Workers: 1}, pooltest.NewProvider(truncating, good))
+
+	// The connection is dropped before reaching the peek size, so the request can be retried transparently.
+	resp, body := get(t, server.URL+testPath)
+	if resp.StatusCode != http.StatusOK || !bytes.Equal(body, testFile) {
+		t.Fatalf("expected file to be served by a different mirror, got status %d", resp.StatusCode)
+	}
+
+	if requests := truncating.Requests(); requests != 1 {
+		t.Fatalf("expected truncating mirror to be evicted after 1 request, got %d", requests)
+	}
+}
+
+func TestPool_Forwards_Head(t *testing.T) {
+	t.Parallel()
+
+	mirror := pooltest.NewMirror(map[string][]byte{testPath: testFile})
+	// Stalling the body makes peeking time out, unless the mirror is not asked for one.
+	mirror.SetBehavior(pooltest.Behavior{Stall: 10 * time.Second})
+	t.Cleanup(mirror.Close)
+
+	server := newServer(t, pool.Config{}, pooltest.NewProvider(mirror))
+
+	resp, err := http.Head(server.URL + testPath)
+	if err != nil {
+		t.Fatalf("requesting file: %v", err)
+	}
+	_ = resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", resp.StatusCode)
+	}
+
+	if resp.ContentLength != int64(len(testFile)) {
+		t.Fatalf("expected Content-Length %d, got %d", len(testFile), resp.ContentLength)
+	}
+
+	if ranges := resp.Header.Get("Accept-Ranges"); ranges != "bytes" {
+		t.Fatalf("expected Accept-Ranges to be forwarded, got %q", ranges)
+	}
+
+	if requests := mirror.Requests(); requests != 1 {
+		t.Fatalf("expected a single request to the mirror, got %d", requests)
+	}
+}
+
+func TestPool_Forwards_Not_Modified(t *testing.T) {
+	t.Parallel()
+
+	mirror := pooltest.NewMirror(map[string][]byte{testPath: testFile})
+	mirror.SetBehavior(pooltest.Behavior{Header: http.Header{"Etag": {`"v1"`}}})
+	t.Cleanup(mirror.Close)
+
+	server := newServer(t, pool.Config{}, pooltest.NewProvider(mirror))
+
+	req, err := http.NewRequest(http.MethodGet, server.URL+testPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("If-None-Match", `"v1"`)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("requesting file: %v", err)
+	}
+	_ = resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNotModified {
+		t.Fatalf("expected status 304, got %d", resp.StatusCode)
+	}
+
+	if etag := resp.Header.Get("ETag"); etag != `"v1"` {
+		t.Fatalf("expected ETag to be forwarded, got %q", etag)
+	}
+}
+
+func TestPool_Evicts_Slow_Mirror(t *testing.T) {
+	t.Parallel()
+
+	slow := pooltest.NewMirror(map[string][]byte{testPath: testFile})
+	slow.SetBehavior(pooltest.Behavior{Stall: 10 * time.Second})
+	t.Cleanup(slow.Close)
+
+	good := pooltest.NewMirror(map[string][]byte{testPath: testFile})
+	t.Cleanup(good.Close)
+
+	server := newServer(t, pool.Config{
+		Workers:           1,
+		PeekTimeout:       5 * time.Second,
+		MinThroughputMiBs: 1,
+		ThroughputWindow:  200 * time.Millisecond,
+	}, pooltest.NewProvider(slow, good))
+
+	start := time.Now()
+	resp, body := get(t, server.URL+testPath)
+	if resp.StatusCode != http.StatusOK || !bytes.Equal(body, testFile) {
+		t.Fatalf("expected file to be served by a different mirror, got status %d", resp.StatusCode)
+	}
+
+	// Without a minimum throughput, the request would only be retried after the peek timed out.
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("expected slow mirror to be abandoned quickly, took %v", elapsed)
+	}
+
+	if requests := slow.Requests(); requests != 1 {
+		t.Fatalf("expected slow mirror to be evicted after 1 request, got %d", requests)
+	}
+}
+
+func TestPool_Aborts_Slow_Transfers(t *testing.T) {
+	t.Parallel()
+
+	const size = 3 * 1024 * 1024
+	file := bytes.Repeat([]byte("refractor"), size/9)
+
+	slow := pooltest.NewMirror(map[string][]byte{testPath: file})
+	// The mirror stalls after the peek, once part of the body has been sent.
+	slow.SetBehavior(pooltest.Behavior{Chunked: true, PauseAfter: size / 2, Stall: 10 * time.Second})
+	t.Cleanup(slow.Close)
+
+	server := newServer(t, pool.Config{
+		Workers:           1,
+		MinThroughputMiBs: 1,
+		ThroughputWindow:  200 * time.Millisecond,
+	}, pooltest.NewProvider(slow))
+
+	resp, err := http.Get(server.URL + testPath)
+	if err != nil {
+		t.Fatalf("requesting file: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err == nil {
+		t.Fatalf("expected reading the abandoned body to fail, got %d out of %d bytes", len(body), len(file))
+	}
+}
+
+func TestPool_Serves_Empty_File(t *testing.T) {
+	t.Parallel()
+
+	mirror := pooltest.NewMirror(map[string][]byte{testPath: {}})
+	t.Cleanup(mirror.Close)
+
+	server := newServer(t, pool.Config{}, pooltest.NewProvider(mirror))
+
+	resp, body := get(t, server.URL+testPath)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", resp.StatusCode)
+	}
+
+	if length := resp.Header.Get("Content-Length"); length != "0" {
+		t.Fatalf("expected Content-Length to be 0, got %q", length)
+	}
+
+	if len(body) != 0 {
+		t.Fatalf("expected empty body, got %d bytes", len(body))
+	}
+}
+
+func TestPool_Status_Policy(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name     string
+		policy   pool.StatusPolicy
+		status   int
+		expected int
+		attempts int
+	}{
+		{name: "Retries_5xx_By_Default", status: http.StatusServiceUnavailable, expected: http.StatusInternalServerError, attempts: 2},
+		{name: "Passes_4xx_By_Default", status: http.StatusNotFound, expected: http.StatusNotFound, attempts: 1},
+		{name: "Retries_Listed_4xx", policy: pool.StatusPolicy{Retry: []int{404}}, status: http.StatusNotFound, expected: http.StatusInternalServerError, attempts: 2},
+		{name: "Passes", policy: pool.StatusPolicy{Pass: []int{404}}, status: http.StatusNotFound, expected: http.StatusNotFound, attempts: 1},
+		{name: "Fails", policy: pool.StatusPolicy{Fail: []int{403}}, status: http.StatusForbidden, expected: http.StatusBadGateway, attempts: 1},
+		{name: "Retries", policy: pool.StatusPolicy{Retry: []int{204}}, status: http.StatusNoContent, expected: http.StatusInternalServerError, attempts: 2},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			mirror := pooltest.NewMirror(nil)
+			mirror.SetBehavior(pooltest.Behavior{Status: tc.status})
+			t.Cleanup(mirror.Close)
+
+			server := newServer(t, pool.Config{Retries: 1, Statuses: tc.policy}, pooltest.NewProvider(mirror))
+
+			resp, _ := get(t, server.URL+testPath)
+			if resp.StatusCode != tc.expected {
+				t.Fatalf("expected status %d, got %d", tc.expected, resp.StatusCode)
+			}
+
+			if requests := mirror.Requests(); requests != tc.attempts {
+				t.Fatalf("expected %d attempts, mirror got %d", tc.attempts, requests)
+			}
+		})
+	}
+}
+
+func TestPool_Passes_Unsatisfiable_Range(t *testing.T) {
+	t.Parallel()
+
+	mirror := pooltest.NewMirror(map[string][]byte{testPath: testFile})
+	t.Cleanup(mirror.Close)
+
+	server := newServer(t, pool.Config{}, pooltest.NewProvider(mirror))
+
+	// Clients resuming a download that is already complete ask for a range past the end of the file.
+	req, err := http.NewRequest(http.MethodGet, server.URL+testPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-", len(testFile)))
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("requesting range: %v", err)
+	}
+	_ = resp.Body.Close()
+
+	if resp.StatusCode != http.StatusRequestedRangeNotSatisfiable {
+		t.Fatalf("expected status 416, got %d", resp.StatusCode)
+	}
+
+	if contentRange, expected := resp.Header.Get("Content-Range"), fmt.Sprintf("bytes */%d", len(testFile)); contentRange != expected {
+		t.Fatalf("expected Content-Range %q to be passed, got %q", expected, contentRange)
+	}
+
+	if requests := mirror.Requests(); requests != 1 {
+		t.Fatalf("expected 1 request to the mirror, got %d", requests)
+	}
+}
+
+func TestPool_Evicts_Unauthorized_Mirror(t *testing.T) {
+	t.Parallel()
+
+	unauthorized := pooltest.NewMirror(map[string][]byte{testPath: testFile})
+	unauthorized.SetBehavior(pooltest.Behavior{Status: http.StatusUnauthorized})
+	t.Cleanup(unauthorized.Close)
+
+	good := pooltest.NewMirror(map[string][]byte{testPath: testFile})
+	t.Cleanup(good.Close)
+
+	server := newServer(t, pool.Config{Workers: 1}, pooltest.NewProvider(unauthorized, good))
+
+	for i := 0; i < 2; i++ {
+		resp, body := get(t, server.URL+testPath)
+		if resp.StatusCode != http.StatusOK || !bytes.Equal(body, testFile) {
+			t.Fatalf("expected file to be served by a different mirror, got status %d", resp.StatusCode)
+		}
+	}
+
+	if requests := unauthorized.Requests(); requests != 1 {
+		t.Fatalf("expected unauthorized mirror to be evicted after 1 request, got %d", requests)
+	}
+}
+
+func TestPool_Consults_IsRetryable(t *testing.T) {
+	t.Parallel()
+
+	dead := pooltest.NewMirror(nil)
+	dead.Close()
+
+	failing := pooltest.NewMirror(nil)
+	failing.SetBehavior(pooltest.Behavior{Status: http.StatusServiceUnavailable})
+	t.Cleanup(failing.Close)
+
+	for _, tc := range []struct {
+		name     string
+		mirror   *pooltest.Mirror
+		response bool
+		expected int
+	}{
+		// Statuses that are not retried are passed to the client.
+		{name: "status", mirror: failing, response: true, expected: http.StatusServiceUnavailable},
+		{name: "unreachable", mirror: dead, response: false, expected: http.StatusBadGateway},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			calls := make(chan *http.Response, 10)
+			config := pool.Config{
+				Workers: 1,
+				IsRetryable: func(err error, response *http.Response) bool {
+					calls <- response
+					return false
+				},
+			}
+			server := newServer(t, config, pooltest.NewProvider(tc.mirror))
+
+			resp, _ := get(t, server.URL+testPath)
+			if resp.StatusCode != tc.expected {
+				t.Fatalf("expected status %d, got %d", tc.expected, resp.StatusCode)
+			}
+
+			if len(calls) != 1 {
+				t.Fatalf("expected IsRetryable to be called once, got %d calls", len(calls))
+			}
+
+			if response := <-calls; (response != nil) != tc.response {
+				t.Fatalf("expected response to be passed: %v, got %v", tc.response, response)
+			}
+		})
+	}
+}
+
+func TestPool_Verifies_Content_Digest(t *testing.T) {
+	t.Parallel()
+
+	sum := sha256.Sum256(testFile)
+	valid := "sha-256=:" + base64.StdEncoding.EncodeToString(sum[:]) + ":"
+	invalid := "sha-256=:" + base64.StdEncoding.EncodeToString(make([]byte, sha256.Size)) + ":"
+
+	for _, tc := range []struct {
+		name   string
+		digest string
+		fails  bool
+	}{
+		{name: "valid", digest: valid},
+		{name: "mismatch", digest: invalid, fails: true},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			mirror := pooltest.NewMirror(map[string][]byte{testPath: testFile})
+			mirror.SetBehavior(pooltest.Behavior{Trailer: http.Header{"Content-Digest": {tc.digest}}})
+			t.Cleanup(mirror.Close)
+
+			server := newServer(t, pool.Config{VerifyTrailers: true}, pooltest.NewProvider(mirror))
+
+			resp, err := http.Get(server.URL + testPath)
+			if err != nil {
+				t.Fatalf("requesting file: %v", err)
+			}
+
+			_, err = io.ReadAll(resp.Body)
+			_ = resp.Body.Close()
+			if tc.fails && err == nil {
+				t.Fatal("expected response with mismatching digest to be aborted")
+			}
+			if !tc.fails && err != nil {
+				t.Fatalf("reading body: %v", err)
+			}
+		})
+	}
+}
+
+func TestPool_Ignores_Unsupported_Trailer_Digest(t *testing.T) {
+	t.Parallel()
+
+	mirror := pooltest.NewMirror(map[string][]byte{testPath: testFile})
+	mirror.SetBehavior(pooltest.Behavior{Trailer: http.Header{"Content-Digest": {"crc32c=:AAAAAA==:"}}})
+	t.Cleanup(mirror.Close)
+
+	p := newPool(t, pool.Config{VerifyTrailers: true}, pooltest.NewProvider(mirror))
+
+	resp, err := p.Fetch(context.Background(), testPath, nil)
+	if err != nil {
+		t.Fatalf("fetching file: %v", err)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil || !bytes.Equal(body, testFile) {
+		t.Fatalf("expected file to be served, got error %v", err)
+	}
+
+	if recent := p.Status().RecentErrors; len(recent) != 0 {
+		t.Fatalf("expected request not to be reported as failed, got %+v", recent)
+	}
+}
+
+func TestPool_Verifies_Announced_Digest(t *testing.T) {
+	t.Parallel()
+
+	small := testFile
+	large := bytes.Repeat([]byte{'x'}, 2*1024*1024)
+	md5Of := func(content []byte) string {
+		sum := md5.Sum(content)
+		return base64.StdEncoding.EncodeToString(sum[:])
+	}
+	sha256Of := func(content []byte) string {
+		sum := sha256.Sum256(content)
+		return base64.StdEncoding.EncodeToString(sum[:])
+	}
+
+	for _, tc := range []struct {
+		name    string
+		file    []byte
+		header  http.Header
+		corrupt bool
+	}{
+		{name: "Content-Digest", file: small, header: http.Header{"Content-Digest": {"sha-256=:" + sha256Of(small) + ":"}}},
+		{name: "Digest", file: small, header: http.Header{"Digest": {"SHA-256=" + sha256Of(small)}}},
+		{name: "Content-MD5", file: small, header: http.Header{"Content-Md5": {md5Of(small)}}},
+		{name: "Large", file: large, header: http.Header{"Content-Md5": {md5Of(large)}}},
+		{name: "Corrupt", file: small, header: http.Header{"Content-Md5": {md5Of(large)}}, corrupt: true},
+		{name: "Corrupt_Large", file: large, header: http.Header{"Content-Md5": {md5Of(small)}}, corrupt: true},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			mirror := pooltest.NewMirror(map[string][]byte{testPath: tc.file})
+			mirror.SetBehavior(pooltest.Behavior{Header: tc.header})
+			t.Cleanup(mirror.Close)
+
+			good := pooltest.NewMirror(map[string][]byte{testPath: tc.file})
+			t.Cleanup(good.Close)
+
+			// The first mirror serves the first request, and the second takes over if it is evicted.
+			server := newServer(t, pool.Config{Workers: 1, VerifyDigests: true}, pooltest.NewProvider(mirror, good))
+
+			resp, err := http.Get(server.URL + testPath)
+			if err != nil {
+				t.Fatalf("requesting file: %v", err)
+			}
+			defer resp.Body.Close()
+
+			body, err := io.ReadAll(resp.Body)
+			switch {
+			case !tc.corrupt:
+				if err != nil || !bytes.Equal(body, tc.file) {
+					t.Fatalf("expected file to be served, got %d bytes and error %v", len(body), err)
+				}
+				if good.Requests() != 0 {
+					t.Fatalf("expected mirror not to be evicted")
+				}
+			case len(tc.file) <= 1024*1024:
+				if err != nil || !bytes.Equal(body, tc.file) || good.Requests() != 1 {
+					t.Fatalf("expected corrupt file to be retried on the second mirror, got %d bytes and error %v", len(body), err)
+				}
+			default:
+				if err == nil {
+					t.Fatalf("expected corrupt response to be aborted")
+				}
+			}
+		})
+	}
+}
+
+func TestPool_Limits_Client_Downloads(t *testing.T) {
+	t.Parallel()
+
+	mirror := pooltest.NewMirror(map[string][]byte{testPath: testFile})
+	mirror.SetBehavior(pooltest.Behavior{Latency: 500 * time.Millisecond})
+	t.Cleanup(mirror.Close)
+
+	server := newServer(t, pool.Config{MaxClientDownloads: 1}, pooltest.NewProvider(mirror))
+
+	done := make(chan int)
+	go func() {
+		resp, err := http.Get(server.URL + testPath)
+		if err != nil {
+			done <- 0
+			return
+		}
+		_ = resp.Body.Close()
+		done <- resp.StatusCode
+	}()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for mirror.Active() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("first request did not reach the mirror")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	resp, _ := get(t, server.URL+testPath)
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("expected second request to get status 429, got %d", resp.StatusCode)
+	}
+
+	if status := <-done; status != http.StatusOK {
+		t.Fatalf("expected first request to get status 200, got %d", status)
+	}
+}
+
+func TestPool_Reports_Retries(t *testing.T) {
+	t.Parallel()
+
+	mirror := pooltest.NewMirror(map[string][]byte{testPath: testFile})
+	mirror.SetBehavior(pooltest.Behavior{Status: http.StatusServiceUnavailable})
+	t.Cleanup(mirror.Close)
+
+	server := newServer(t, pool.Config{Retries: 2, DebugHeaders: true}, pooltest.NewProvider(mirror))
+
+	resp, _ := get(t, server.URL+testPath)
+	if retries := resp.Header.Get("X-Refracted-Retries"); retries != "2" {
+		t.Fatalf("expected 2 retries to be reported, got %q", retries)
+	}
+
+	if id := resp.Header.Get("X-Refracted-Download"); id == "" {
+		t.Fatalf("expected download ID to be reported")
+	}
+}
+
+func TestPool_Normalizes_Paths(t *testing.T) {
+	t.Parallel()
+
+	mirror := pooltest.NewMirror(map[string][]byte{testPath: testFile})
+	t.Cleanup(mirror.Close)
+
+	server := newServer(t, pool.Config{NormalizePaths: true}, pooltest.NewProvider(mirror))
+
+	for _, path := range []string{
+		"/core/os/x86_64//core.db",
+		"/core/os/x86_64/core.db/",
+		"/core/os/./x86_64/core.db",
+		"/core/os/x86_64/core.db?foo",
+	} {
+		path := path
+		t.Run(path, func(t *testing.T) {
+			t.Parallel()
+
+			resp, body := get(t, server.URL+path)
+			if resp.StatusCode != http.StatusOK || !bytes.Equal(body, testFile) {
+				t.Fatalf("expected %s to be served as %s, got status %d", path, testPath, resp.StatusCode)
+			}
+		})
+	}
+}
+
+func TestPool_Limits_Mirror_Bandwidth(t *testing.T) {
+	t.Parallel()
+
+	// Large enough for the limit to kick in after the initial burst.
+	file := bytes.Repeat([]byte{'x'}, 256*1024)
+
+	for _, tc := range []struct {
+		name    string
+		limits  pool.BandwidthLimits
+		limited bool
+	}{
+		{name: "matching", limits: pool.BandwidthLimits{{Mirror: `^http://127\.0\.0\.1`, MiBs: 1}}, limited: true},
+		{name: "not matching", limits: pool.BandwidthLimits{{Mirror: `^https://slow\.example/`, MiBs: 0.1}}},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			mirror := pooltest.NewMirror(map[string][]byte{testPath: file})
+			t.Cleanup(mirror.Close)
+
+			err := tc.limits.Compile()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			server := newServer(t, pool.Config{BandwidthLimits: tc.limits}, pooltest.NewProvider(mirror))
+
+			start := time.Now()
+			resp, body := get(t, server.URL+testPath)
+			elapsed := time.Since(start)
+			if resp.StatusCode != http.StatusOK || !bytes.Equal(body, file) {
+				t.Fatalf("expected file to be served, got status %d", resp.StatusCode)
+			}
+
+			// The 192KiB over the burst take around 190ms at 1MiB/s, and almost 2s at 0.1MiB/s.
+			if tc.limited && elapsed < 150*time.Millisecond {
+				t.Fatalf("expected throttled download to take at least 150ms, took %v", elapsed)
+			}
+			if !tc.limited && elapsed > time.Second {
+				t.Fatalf("expected unthrottled download to take less than 1s, took %v", elapsed)
+			}
+		})
+	}
+}
+
+func TestPool_Limits_Bandwidth(t *testing.T) {
+	t.Parallel()
+
+	file := bytes.Repeat([]byte{'x'}, 256*1024)
+
+	for _, tc := range []struct {
+		name   string
+		config pool.Config
+	}{
+		{name: "total", config: pool.Config{MaxMiBs: 1}},
+		{name: "per client", config: pool.Config{ClientMiBs: 1}},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			mirror := pooltest.NewMirror(map[string][]byte{testPath: file})
+			t.Cleanup(mirror.Close)
+
+			server := newServer(t, tc.config, pooltest.NewProvider(mirror))
+
+			// Concurrent downloads share the limit, so the 448KiB over the burst take around 440ms at 1MiB/s.
+			start := time.Now()
+			done := make(chan struct{})
+			for i := 0; i < 2; i++ {
+				go func() {
+					defer func() { done <- struct{}{} }()
+
+					resp, err := http.Get(server.URL + testPath)
+					if err != nil {
+						return
+					}
+					_, _ = io.Copy(io.Discard, resp.Body)
+					_ = resp.Body.Close()
+				}()
+			}
+			<-done
+			<-done
+
+			if elapsed := time.Since(start); elapsed < 350*time.Millisecond {
+				t.Fatalf("expected throttled downloads to take at least 350ms, took %v", elapsed)
+			}
+		})
+	}
+}
+
+func TestPool_Does_Not_Sample_Bandwidth_Limits(t *testing.T) {
+	t.Parallel()
+
+	mirrorLimits := pool.BandwidthLimits{{MiBs: 1}}
+	err := mirrorLimits.Compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file := bytes.Repeat([]byte{'x'}, 512*1024)
+
+	for _, tc := range []struct {
+		name   string
+		config pool.Config
+	}{
+		{name: "total", config: pool.Config{MaxMiBs: 1}},
+		{name: "per mirror", config: pool.Config{BandwidthLimits: mirrorLimits}},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			mirror := pooltest.NewMirror(map[string][]byte{testPath: file})
+			t.Cleanup(mirror.Close)
+
+			p := newPool(t, tc.config, pooltest.NewProvider(mirror))
+			server := httptest.NewServer(p)
+			t.Cleanup(server.Close)
+
+			start := time.Now()
+			resp, _ := get(t, server.URL+testPath)
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("expected status 200, got %d", resp.StatusCode)
+			}
+
+			if elapsed := time.Since(start); elapsed < 350*time.Millisecond {
+				t.Fatalf("expected throttled download to take at least 350ms, took %v", elapsed)
+			}
+
+			// Samples are recorded asynchronously.
+			time.Sleep(100 * time.Millisecond)
+			for _, rank := range p.Ranking() {
+				if rank.ThroughputMiBs < 2 {
+					t.Fatalf("expected mirror not to be ranked at the throttled rate, got %.2f MiB/s", rank.ThroughputMiBs)
+				}
+			}
+		})
+	}
+}
+
+func TestPool_Aborts_On_Client_Disconnect(t *testing.T) {
+	t.Parallel()
+
+	file := bytes.Repeat([]byte{'x'}, 8*1024*1024)
+	mirror := pooltest.NewMirror(map[string][]byte{testPath: file})
+	t.Cleanup(mirror.Close)
+
+	// Throttle the mirror so the download is still in progress when the client goes away.
+	limits := pool.BandwidthLimits{{MiBs: 1}}
+	err := limits.Compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := newServer(t, pool.Config{BandwidthLimits: limits}, pooltest.NewProvider(mirror))
+
+	resp, err := http.Get(server.URL + testPath)
+	if err != nil {
+		t.Fatalf("requesting file: %v", err)
+	}
+
+	_, err = io.CopyN(io.Discard, resp.Body, 1536*1024)
+	if err != nil {
+		t.Fatalf("reading body: %v", err)
+	}
+	resp.Body.Close()
+
+	deadline := time.Now().Add(3 * time.Second)
+	for mirror.Active() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected transfer from the mirror to be cancelled")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Give the pool a chance to wrongly retry the request.
+	time.Sleep(200 * time.Millisecond)
+	if requests := mirror.Requests(); requests != 1 {
+		t.Fatalf("expected aborted download not to be retried, mirror got %d requests", requests)
+	}
+}
+
+func TestPool_Cancels_Attempts_On_Client_Disconnect(t *testing.T) {
+	t.Parallel()
+
+	mirror := pooltest.NewMirror(map[string][]byte{testPath: testFile})
+	mirror.SetBehavior(pooltest.Behavior{Stall: 5 * time.Second})
+	t.Cleanup(mirror.Close)
+
+	server := newServer(t, pool.Config{PeekTimeout: 10 * time.Second}, pooltest.NewProvider(mirror))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+testPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = http.DefaultClient.Do(req)
+	if err == nil {
+		t.Fatalf("expected request to be canceled")
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for mirror.Active() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected transfer from the mirror to be cancelled")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Give the pool a chance to wrongly retry the request.
+	time.Sleep(200 * time.Millisecond)
+	if requests := mirror.Requests(); requests != 1 {
+		t.Fatalf("expected abandoned request not to be retried, mirror got %d requests", requests)
+	}
+}
+
+func TestPool_Cancels_Download(t *testing.T) {
+	t.Parallel()
+
+	file := bytes.Repeat([]byte{'x'}, 8*1024*1024)
+	mirror := pooltest.NewMirror(map[string][]byte{testPath: file})
+	t.Cleanup(mirror.Close)
+
+	limits := pool.BandwidthLimits{{MiBs: 1}}
+	err := limits.Compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := newPool(t, pool.Config{BandwidthLimits: limits}, pooltest.NewProvider(mirror))
+	server := httptest.NewServer(p)
+	t.Cleanup(server.Close)
+
+	resp, err := http.Get(server.URL + testPath)
+	if err != nil {
+		t.Fatalf("requesting file: %v", err)
+	}
+	defer resp.Body.Close()
+
+	downloads := p.Downloads()
+	if len(downloads) != 1 {
+		t.Fatalf("expected one download in progress, got %d", len(downloads))
+	}
+
+	if p.CancelDownload("unknown") {
+		t.Fatalf("expected canceling an unknown download to fail")
+	}
+	if !p.CancelDownload(downloads[0].ID) {
+		t.Fatalf("expected download to be canceled")
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err == nil {
+		t.Fatalf("expected canceled response to be aborted, got %d bytes", len(body))
+	}
+
+	deadline := time.Now().Add(3 * time.Second)
+	for mirror.Active() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected transfer from the mirror to be cancelled")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPool_Caps_Egress(t *testing.T) {
+	t.Parallel()
+
+	mirror := pooltest.NewMirror(map[string][]byte{testPath: testFile})
+	t.Cleanup(mirror.Close)
+
+	// 1KiB, less than a single download.
+	server := newServer(t, pool.Config{EgressCapGiBs: 1.0 / 1024 / 1024}, pooltest.NewProvider(mirror))
+
+	resp, body := get(t, server.URL+testPath)
+	if resp.StatusCode != http.StatusOK || !bytes.Equal(body, testFile) {
+		t.Fatalf("expected file to be served before reaching the cap, got status %d", resp.StatusCode)
+	}
+
+	resp, _ = get(t, server.URL+testPath)
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected status %d after reaching the cap, got %d", http.StatusServiceUnavailable, resp.StatusCode)
+	}
+	if resp.Header.Get("Retry-After") == "" {
+		t.Fatalf("expected Retry-After header to be set")
+	}
+	if requests := mirror.Requests(); requests != 1 {
+		t.Fatalf("expected capped request not to reach the mirror, mirror got %d requests", requests)
+	}
+}
+
+func TestPool_Pins_Paths_To_Mirror(t *testing.T) {
+	t.Parallel()
+
+	pooled := pooltest.NewMirror(map[string][]byte{testPath: testFile})
+	t.Cleanup(pooled.Close)
+
+	origin := pooltest.NewMirror(map[string][]byte{testPath: testFile})
+	t.Cleanup(origin.Close)
+
+	rs := rules.Rules{{Suffix: ".db", Mirror: origin.URL()}}
+	err := rs.Compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := newServer(t, pool.Config{Rules: rs}, pooltest.NewProvider(pooled))
+
+	resp, body := get(t, server.URL+testPath)
+	if resp.StatusCode != http.StatusOK || !bytes.Equal(body, testFile) {
+		t.Fatalf("expected file to be served, got status %d", resp.StatusCode)
+	}
+
+	if origin.Requests() != 1 || pooled.Requests() != 0 {
+		t.Fatalf("expected file to be requested from the pinned mirror only, got %d requests to it and %d to the pool",
+			origin.Requests(), pooled.Requests())
+	}
+}
+
+func TestPool_Serves_From_Cache(t *testing.T) {
+	t.Parallel()
+
+	const pkgPath = "/core/os/x86_64/linux-6.0.pkg.tar.zst"
+
+	mirror := pooltest.NewMirror(map[string][]byte{testPath: testFile, pkgPath: testFile})
+	t.Cleanup(mirror.Close)
+
+	c, err := cache.New(cache.Config{Dir: t.TempDir(), MaxSizeMiBs: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := newServer(t, pool.Config{Cache: c}, pooltest.NewProvider(mirror))
+
+	for _, tc := range []struct {
+		path     string
+		requests int
+	}{
+		{path: pkgPath, requests: 1},
+		{path: testPath, requests: 2},
+	} {
+		before := mirror.Requests()
+		for i := 0; i < 2; i++ {
+			resp, body := get(t, server.URL+tc.path)
+			if resp.StatusCode != http.StatusOK || !bytes.Equal(body, testFile) {
+				t.Fatalf("expected %s to be served, got status %d", tc.path, resp.StatusCode)
+			}
+		}
+
+		if requests := mirror.Requests() - before; requests != tc.requests {
+			t.Fatalf("expected %s to be requested from mirrors %d times, got %d", tc.path, tc.requests, requests)
+		}
+	}
+}
+
+func TestPool_Serves_Stale_Copy(t *testing.T) {
+	t.Parallel()
+
+	const pkgPath = "/core/os/x86_64/linux-6.0.pkg.tar.zst"
+
+	for _, tc := range []struct {
+		name       string
+		serveStale bool
+		expected   int
+	}{
+		{name: "enabled", serveStale: true, expected: http.StatusOK},
+		{name: "disabled", serveStale: false, expected: http.StatusInternalServerError},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			mirror := pooltest.NewMirror(map[string][]byte{pkgPath: testFile})
+			t.Cleanup(mirror.Close)
+
+			c, err := cache.New(cache.Config{
+				Dir:         t.TempDir(),
+				MaxSizeMiBs: 1,
+				Rules:       []cache.Rule{{Suffix: ".pkg.tar.zst", TTL: time.Nanosecond}},
+				ServeStale:  tc.serveStale,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			server := newServer(t, pool.Config{Retries: 1, Cache: c}, pooltest.NewProvider(mirror))
+
+			resp, _ := get(t, server.URL+pkgPath)
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("expected status 200, got %d", resp.StatusCode)
+			}
+
+			mirror.SetBehavior(pooltest.Behavior{Status: http.StatusServiceUnavailable})
+
+			resp, body := get(t, server.URL+pkgPath)
+			if resp.StatusCode != tc.expected {
+				t.Fatalf("expected status %d once mirrors fail, got %d", tc.expected, resp.StatusCode)
+			}
+
+			if !tc.serveStale {
+				return
+			}
+
+			if !bytes.Equal(body, testFile) {
+				t.Fatalf("expected stale copy to be served")
+			}
+
+			if warning := resp.Header.Get("Warning"); warning == "" {
+				t.Fatalf("expected stale copy to be served with a Warning header")
+			}
+		})
+	}
+}
+
+func TestPool_Buffers_Slow_Clients_Of_Cached_Files(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name      string
+		bufferMiB float64
+		ahead     bool
+	}{
+		{name: "buffered", bufferMiB: 32, ahead: true},
+		{name: "lockstep", bufferMiB: 0, ahead: false},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			// Large enough not to fit in the socket buffers, so a client not reading stalls writes to it.
+			file := bytes.Repeat([]byte{'x'}, 16*1024*1024)
+			mirror := pooltest.NewMirror(map[string][]byte{testPath: file})
+			t.Cleanup(mirror.Close)
+
+			p := newPool(t, pool.Config{Cache: &memoryCache{}, CacheBufferMiBs: tc.bufferMiB}, pooltest.NewProvider(mirror))
+			server := httptest.NewServer(p)
+			t.Cleanup(server.Close)
+
+			resp, err := http.Get(server.URL + testPath)
+			if err != nil {
+				t.Fatalf("requesting file: %v", err)
+			}
+			defer resp.Body.Close()
+
+			// The client does not read the body until the file is cached, or until it is clear it will not be.
+			deadline := time.Now().Add(time.Second)
+			for p.Status().CacheBytes == 0 && time.Now().Before(deadline) {
+				time.Sleep(10 * time.Millisecond)
+			}
+
+			if ahead := p.Status().CacheBytes == int64(len(file)); ahead != tc.ahead {
+				t.Fatalf("expected file to be cached before the client read it: %v, got %v", tc.ahead, ahead)
+			}
+
+			body, err := io.ReadAll(resp.Body)
+			if err != nil || !bytes.Equal(body, file) {
+				t.Fatalf("expected whole file to be sent to the client, got %d bytes (%v)", len(body), err)
+			}
+		})
+	}
+}
+
+func TestPool_Revalidates_Cached_Files(t *testing.T) {
+	t.Parallel()
+
+	mirror := pooltest.NewMirror(map[string][]byte{testPath: []byte("v1")})
+	mirror.SetBehavior(pooltest.Behavior{Header: http.Header{"Etag": {`"v1"`}}})
+	t.Cleanup(mirror.Close)
+
+	c, err := cache.New(cache.Config{
+		Dir:         t.TempDir(),
+		MaxSizeMiBs: 1,
+		Rules:       []cache.Rule{{Suffix: ".db", Revalidate: true}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := newServer(t, pool.Config{Cache: c}, pooltest.NewProvider(mirror))
+
+	for _, tc := range []struct {
+		name     string
+		etag     string
+		content  string
+		expected string
+	}{
+		{name: "first request", etag: `"v1"`, content: "v1", expected: "v1"},
+		// Mirrors are trusted to report changes, so the cached copy is served as long as the ETag matches.
+		{name: "not modified", etag: `"v1"`, content: "changed", expected: "v1"},
+		{name: "modified", etag: `"v2"`, content: "v2", expected: "v2"},
+		{name: "modified copy is cached", etag: `"v2"`, content: "changed again", expected: "v2"},
+	} {
+		mirror.SetFile(testPath, []byte(tc.content))
+		mirror.SetBehavior(pooltest.Behavior{Header: http.Header{"Etag": {tc.etag}}})
+
+		before := mirror.Requests()
+		resp, body := get(t, server.URL+testPath)
+		if resp.StatusCode != http.StatusOK || string(body) != tc.expected {
+			t.Fatalf("%s: expected %q to be served, got status %d and %q", tc.name, tc.expected, resp.StatusCode, body)
+		}
+
+		if requests := mirror.Requests() - before; requests != 1 {
+			t.Fatalf("%s: expected file to be revalidated with a single request, got %d", tc.name, requests)
+		}
+	}
+}
+
+func TestPool_Preloads_Cache(t *testing.T) {
+	t.Parallel()
+
+	const (
+		pkgPath     = "/core/os/x86_64/linux-6.0.pkg.tar.zst"
+		otherPath   = "/core/os/x86_64/glibc-2.36.pkg.tar.zst"
+		missingPath = "/core/os/x86_64/missing-1.0.pkg.tar.zst"
+	)
+
+	mirror := pooltest.NewMirror(map[string][]byte{testPath: testFile, pkgPath: testFile, otherPath: testFile})
+	t.Cleanup(mirror.Close)
+
+	c, err := cache.New(cache.Config{Dir: t.TempDir(), MaxSizeMiBs: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := newPool(t, pool.Config{Cache: c}, pooltest.NewProvider(mirror))
+
+	results, err := p.Preload(context.Background(), []string{pkgPath, otherPath, missingPath, testPath}, 2)
+	if err != nil {
+		t.Fatalf("preloading: %v", err)
+	}
+
+	expected := []pool.PreloadResult{
+		{Path: pkgPath, Status: http.StatusOK},
+		{Path: otherPath, Status: http.StatusOK},
+		{Path: missingPath, Status: http.StatusNotFound, Error: "pool answered with status 404"},
+		{Path: testPath, Error: "not cacheable"},
+	}
+	if len(results) != len(expected) {
+		t.Fatalf("expected %d results, got %+v", len(expected), results)
+	}
+	for i := range expected {
+		if results[i] != expected[i] {
+			t.Fatalf("expected result %d to be %+v, got %+v", i, expected[i], results[i])
+		}
+	}
+
+	if size := c.Size(); size != int64(2*len(testFile)) {
+		t.Fatalf("expected both packages to be cached, cache holds %d bytes", size)
+	}
+
+	before := mirror.Requests()
+	_, err = p.Preload(context.Background(), []string{pkgPath, otherPath}, 2)
+	if err != nil {
+		t.Fatalf("preloading: %v", err)
+	}
+	if requests := mirror.Requests() - before; requests != 0 {
+		t.Fatalf("expected cached paths not to be downloaded again, mirror got %d requests", requests)
+	}
+}
+
+// memoryCache is a pool.Cache keeping files in memory, which stores every path.
+type memoryCache struct {
+	mtx   sync.Mutex
+	files map[string][]byte
+}
+
+func (mc *memoryCache) Cacheable(string) bool {
+	return true
+}
+
+func (mc *memoryCache) Get(path string) (io.ReadSeekCloser, time.Time, bool) {
+	mc.mtx.Lock()
+	defer mc.mtx.Unlock()
+
+	content, found := mc.files[path]
+	if !found {
+		return nil, time.Time{}, false
+	}
+
+	return memoryFile{Reader: bytes.NewReader(content)}, time.Time{}, true
+}
+
+func (mc *memoryCache) GetStale(path string) (io.ReadSeekCloser, time.Time, bool) {
+	return mc.Get(path)
+}
+
+func (mc *memoryCache) Validators(string) (string, string, bool) {
+	return "", "", false
+}
+
+func (mc *memoryCache) Refresh(path string) (io.ReadSeekCloser, time.Time, bool) {
+	return mc.Get(path)
+}
+
+func (mc *memoryCache) Create(path string) (cache.Entry, error) {
+	return &memoryEntry{cache: mc, path: path}, nil
+}
+
+func (mc *memoryCache) Size() int64 {
+	mc.mtx.Lock()
+	defer mc.mtx.Unlock()
+
+	size := 0
+	for _, content := range mc.files {
+		size += len(content)
+	}
+
+	return int64(size)
+}
+
+type memoryFile struct {
+	*bytes.Reader
+}
+
+func (memoryFile) Close() error {
+	return nil
+}
+
+type memoryEntry struct {
+	bytes.Buffer
+	cache *memoryCache
+	path  string
+}
+
+func (me *memoryEntry) Size() int64 {
+	return int64(me.Len())
+}
+
+func (me *memoryEntry) Commit() error {
+	me.cache.mtx.Lock()
+	defer me.cache.mtx.Unlock()
+
+	if me.cache.files == nil {
+		me.cache.files = map[string][]byte{}
+	}
+	me.cache.files[me.path] = me.Bytes()
+	return nil
+}
+
+func (me *memoryEntry) SetValidators(string, string) {}
+
+func (me *memoryEntry) Discard() {}
+
+func TestPool_Uses_Pluggable_Cache(t *testing.T) {
+	t.Parallel()
+
+	mirror := pooltest.NewMirror(map[string][]byte{testPath: testFile})
+	t.Cleanup(mirror.Close)
+
+	p := newPool(t, pool.Config{Cache: &memoryCache{}}, pooltest.NewProvider(mirror))
+	server := httptest.NewServer(p)
+	t.Cleanup(server.Close)
+
+	for i := 0; i < 2; i++ {
+		resp, body := get(t, server.URL+testPath)
+		if resp.StatusCode != http.StatusOK || !bytes.Equal(body, testFile) {
+			t.Fatalf("expected file to be served, got status %d", resp.StatusCode)
+		}
+	}
+
+	if requests := mirror.Requests(); requests != 1 {
+		t.Fatalf("expected file to be requested from mirrors once, got %d", requests)
+	}
+
+	if size := p.Status().CacheBytes; size != int64(len(testFile)) {
+		t.Fatalf("expected cache to hold %d bytes, got %d", len(testFile), size)
+	}
+}
+
+func TestPool_Prefetches_Into_Cache(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name     string
+		prefetch bool
+		cached   int64
+	}{
+		{name: "enabled", prefetch: true, cached: 2 * 1024 * 1024},
+		{name: "disabled", prefetch: false, cached: 0},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			file := bytes.Repeat([]byte{'x'}, 2*1024*1024)
+			mirror := pooltest.NewMirror(map[string][]byte{testPath: file})
+			t.Cleanup(mirror.Close)
+			// Pause the transfer so the client goes away before it is complete.
+			mirror.SetBehavior(pooltest.Behavior{Chunked: true, PauseAfter: 1536 * 1024, Stall: 500 * time.Millisecond})
+
+			p := newPool(t, pool.Config{Cache: &memoryCache{}, CachePrefetch: tc.prefetch}, pooltest.NewProvider(mirror))
+			server := httptest.NewServer(p)
+			t.Cleanup(server.Close)
+
+			resp, err := http.Get(server.URL + testPath)
+			if err != nil {
+				t.Fatalf("requesting file: %v", err)
+			}
+
+			_, err = io.CopyN(io.Discard, resp.Body, 1024*1024)
+			if err != nil {
+				t.Fatalf("reading body: %v", err)
+			}
+			resp.Body.Close()
+
+			deadline := time.Now().Add(3 * time.Second)
+			for mirror.Active() != 0 || p.Status().CacheBytes != tc.cached {
+				if time.Now().After(deadline) {
+					t.Fatalf("expected cache to hold %d bytes, got %d", tc.cached, p.Status().CacheBytes)
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+
+			if !tc.prefetch {
+				return
+			}
+
+			resp, body := get(t, server.URL+testPath)
+			if resp.StatusCode != http.StatusOK || !bytes.Equal(body, file) {
+				t.Fatalf("expected prefetched file to be served, got status %d", resp.StatusCode)
+			}
+
+			if requests := mirror.Requests(); requests != 1 {
+				t.Fatalf("expected prefetched file to be served from cache, mirror got %d requests", requests)
+			}
+		})
+	}
+}
+
+func TestPool_Applies_Rule_Policy(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name     string
+		policy   rules.Policy
+		behavior pooltest.Behavior
+		status   int
+		requests int
+	}{
+		{
+			name:     "retries",
+			policy:   rules.Policy{Retries: ptr(1)},
+			behavior: pooltest.Behavior{Status: http.StatusServiceUnavailable},
+			status:   http.StatusInternalServerError,
+			requests: 2,
+		},
+		{
+			name:     "no retries",
+			policy:   rules.Policy{Retries: ptr(0)},
+			behavior: pooltest.Behavior{Status: http.StatusServiceUnavailable},
+			status:   http.StatusInternalServerError,
+			requests: 1,
+		},
+		{
+			// The pool times requests out after 200ms.
+			name:     "no request timeout",
+			policy:   rules.Policy{RequestTimeout: ptr(time.Duration(0))},
+			behavior: pooltest.Behavior{Latency: 500 * time.Millisecond},
+			status:   http.StatusOK,
+			requests: 1,
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			mirror := pooltest.NewMirror(map[string][]byte{testPath: testFile})
+			mirror.SetBehavior(tc.behavior)
+			t.Cleanup(mirror.Close)
+
+			rs := rules.Rules{{Suffix: ".db", Policy: tc.policy}}
+			err := rs.Compile()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			config := pool.Config{Retries: 5, RequestTimeout: 200 * time.Millisecond, Rules: rs}
+			server := newServer(t, config, pooltest.NewProvider(mirror))
+
+			resp, _ := get(t, server.URL+testPath)
+			if resp.StatusCode != tc.status {
+				t.Fatalf("expected status %d as per rule policy, got %d", tc.status, resp.StatusCode)
+			}
+
+			if requests := mirror.Requests(); requests != tc.requests {
+				t.Fatalf("expected mirror to be tried %d times as per rule policy, got %d requests", tc.requests, requests)
+			}
+		})
+	}
+}
+
+// ptr returns a pointer to v, to set rule policy fields.
+func ptr[T any](v T) *T {
+	return &v
+}
+
+func TestPool_Drains_Mirror(t *testing.T) {
+	t.Parallel()
+
+	mirror := pooltest.NewMirror(map[string][]byte{testPath: testFile})
+	t.Cleanup(mirror.Close)
+
+	p := newPool(t, pool.Config{Workers: 1}, pooltest.NewProvider(mirror))
+	server := httptest.NewServer(p)
+	t.Cleanup(server.Close)
+
+	resp, _ := get(t, server.URL+testPath)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", resp.StatusCode)
+	}
+
+	if p.DrainMirror("http://unknown.example/") {
+		t.Fatalf("expected draining a mirror not in the pool to fail")
+	}
+
+	mirrors := p.Mirrors()
+	if len(mirrors) != 1 || !p.DrainMirror(mirrors[0]) {
+		t.Fatalf("expected mirror %v to be drained", mirrors)
+	}
+
+	// The drained worker hands the request over to a new one before leaving the pool.
+	resp, _ = get(t, server.URL+testPath)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200 after draining, got %d", resp.StatusCode)
+	}
+}
+
+func TestPool_Reports_Recent_Errors(t *testing.T) {
+	t.Parallel()
+
+	failing := pooltest.NewMirror(map[string][]byte{testPath: testFile})
+	failing.SetBehavior(pooltest.Behavior{Status: http.StatusServiceUnavailable})
+	t.Cleanup(failing.Close)
+
+	p := newPool(t, pool.Config{Retries: 1}, pooltest.NewProvider(failing))
+	server := httptest.NewServer(p)
+	t.Cleanup(server.Close)
+
+	_, _ = get(t, server.URL+testPath)
+
+	status := p.Status()
+	if len(status.RecentErrors) != 1 || status.RecentErrors[0].Path != testPath {
+		t.Fatalf("expected failed request to be reported, got %+v", status.RecentErrors)
+	}
+
+	if status.Downloads != 0 {
+		t.Fatalf("expected no downloads in progress, got %d", status.Downloads)
+	}
+}
+
+func TestPool_Fetches_File(t *testing.T) {
+	t.Parallel()
+
+	mirror := pooltest.NewMirror(map[string][]byte{testPath: testFile})
+	t.Cleanup(mirror.Close)
+
+	p := newPool(t, pool.Config{}, pooltest.NewProvider(mirror))
+
+	resp, err := p.Fetch(context.Background(), testPath, nil)
+	if err != nil {
+		t.Fatalf("fetching file: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("reading body: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusOK || !bytes.Equal(body, testFile) {
+		t.Fatalf("expected file to be fetched, got status %d", resp.StatusCode)
+	}
+
+	if resp.ContentLength != int64(len(testFile)) {
+		t.Fatalf("expected Content-Length %d, got %d", len(testFile), resp.ContentLength)
+	}
+
+	resp, err = p.Fetch(context.Background(), "/missing", nil)
+	if err != nil {
+		t.Fatalf("fetching missing file: %v", err)
+	}
+	_ = resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		t.Fatalf("expected missing file to fail")
+	}
+}
+
+func TestPool_Fetch_Fails_When_Canceled_Before_Start(t *testing.T) {
+	t.Parallel()
+
+	mirror := pooltest.NewMirror(map[string][]byte{testPath: testFile})
+	t.Cleanup(mirror.Close)
+
+	p := newPool(t, pool.Config{}, pooltest.NewProvider(mirror))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	resp, err := p.Fetch(ctx, testPath, nil)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected fetch to fail with context.Canceled, got response %+v, err %v", resp, err)
+	}
+}
+
+func TestPool_Fetch_Fails_Truncated_Body(t *testing.T) {
+	t.Parallel()
+
+	// Larger than the peek size, so the connection is dropped after the response has started.
+	file := bytes.Repeat(testFile, 3*1024*1024/len(testFile))
+
+	truncating := pooltest.NewMirror(map[string][]byte{testPath: file})
+	truncating.SetBehavior(pooltest.Behavior{TruncateAfter: 2 * 1024 * 1024})
+	t.Cleanup(truncating.Close)
+
+	p := newPool(t, pool.Config{Workers: 1}, pooltest.NewProvider(truncating))
+
+	resp, err := p.Fetch(context.Background(), testPath, nil)
+	if err != nil {
+		t.Fatalf("fetching file: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err == nil {
+		t.Fatalf("expected truncated body to fail, read %d bytes", len(body))
+	}
+}
+
+func TestPool_Writes_Audit_Records(t *testing.T) {
+	t.Parallel()
+
+	good := pooltest.NewMirror(map[string][]byte{testPath: testFile})
+	t.Cleanup(good.Close)
+
+	failing := pooltest.NewMirror(nil)
+	failing.SetBehavior(pooltest.Behavior{Status: http.StatusServiceUnavailable})
+	t.Cleanup(failing.Close)
+
+	for _, tc := range []struct {
+		name     string
+		mirror   *pooltest.Mirror
+		expected pool.AuditRecord
+	}{
+		{
+			name:     "success",
+			mirror:   good,
+			expected: pool.AuditRecord{Path: testPath, Mirror: good.URL(), Status: http.StatusOK},
+		},
+		{
+			name:     "exhausted",
+			mirror:   failing,
+			expected: pool.AuditRecord{Path: testPath, Status: http.StatusInternalServerError, Retries: 1, Error: "max retries exhausted"},
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			audit := &bytes.Buffer{}
+			p := newPool(t, pool.Config{Retries: 1, Audit: audit}, pooltest.NewProvider(tc.mirror))
+
+			resp, err := p.Fetch(context.Background(), testPath, nil)
+			if err != nil {
+				t.Fatalf("fetching file: %v", err)
+			}
+
+			// The record is written before the body is closed.
+			_, _ = io.Copy(io.Discard, resp.Body)
+			_ = resp.Body.Close()
+
+			var record pool.AuditRecord
+			err = json.Unmarshal(audit.Bytes(), &record)
+			if err != nil {
+				t.Fatalf("decoding audit record %q: %v", audit.String(), err)
+			}
+
+			if record.Path != tc.expected.Path || record.Mirror != tc.expected.Mirror || record.Status != tc.expected.Status ||
+				record.Retries != tc.expected.Retries || record.Error != tc.expected.Error {
+				t.Fatalf("expected record like %+v, got %+v", tc.expected, record)
+			}
+		})
+	}
+}
+
+func TestPool_Audits_Requests_Not_Served_By_Mirrors(t *testing.T) {
+	t.Parallel()
+
+	const sigPath = testPath + ".sig"
+
+	mirror := pooltest.NewMirror(map[string][]byte{testPath: testFile})
+	t.Cleanup(mirror.Close)
+
+	rs := rules.Rules{{Suffix: ".sig", Status: http.StatusNotFound}}
+	err := rs.Compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	audit := &bytes.Buffer{}
+	p := newPool(t, pool.Config{Cache: &memoryCache{}, Rules: rs, Audit: audit}, pooltest.NewProvider(mirror))
+
+	for _, path := range []string{testPath, testPath, sigPath} {
+		resp, err := p.Fetch(context.Background(), path, nil)
+		if err != nil {
+			t.Fatalf("fetching %s: %v", path, err)
+		}
+		_, _ = io.Copy(io.Discard, resp.Body)
+		_ = resp.Body.Close()
+	}
+
+	expected := []pool.AuditRecord{
+		{Path: testPath, Mirror: mirror.URL(), Status: http.StatusOK, Bytes: int64(len(testFile))},
+		{Path: testPath, Source: "cache", Status: http.StatusOK, Bytes: int64(len(testFile))},
+		{Path: sigPath, Source: "rule", Status: http.StatusNotFound},
+	}
+
+	decoder := json.NewDecoder(audit)
+	for i := range expected {
+		var record pool.AuditRecord
+		err := decoder.Decode(&record)
+		if err != nil {
+			t.Fatalf("decoding audit record #%d: %v", i, err)
+		}
+
+		if record.Path != expected[i].Path || record.Mirror != expected[i].Mirror || record.Source != expected[i].Source ||
+			record.Status != expected[i].Status || record.Bytes != expected[i].Bytes {
+			t.Fatalf("expected record #%d like %+v, got %+v", i, expected[i], record)
+		}
+	}
+}
+
+func TestPool_Ranks_Downloads_In_Progress(t *testing.T) {
+	t.Parallel()
+
+	mirror := pooltest.NewMirror(map[string][]byte{testPath: testFile})
+	// Latency makes the first download slow enough to be sampled, so the worker is ranked.
+	mirror.SetBehavior(pooltest.Behavior{Latency: 100 * time.Millisecond})
+	t.Cleanup(mirror.Close)
+
+	// Both workers are assigned the same mirror, so the one that gets ranked is not rotated out for being the only
+	// one outside the top.
+	p := newPool(t, pool.Config{Workers: 2, PeekTimeout: 5 * time.Second}, pooltest.NewProvider(mirror))
+	server := httptest.NewServer(p)
+	t.Cleanup(server.Close)
+
+	get(t, server.URL+testPath)
+
+	mirror.SetBehavior(pooltest.Behavior{Stall: 500 * time.Millisecond})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		resp, err := http.Get(server.URL + testPath)
+		if err == nil {
+			_, _ = io.Copy(io.Discard, resp.Body)
+			_ = resp.Body.Close()
+		}
+	}()
+
+	var ranking []stats.Rank
+	for deadline := time.Now().Add(400 * time.Millisecond); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		ranking = p.Ranking()
+		if len(ranking) == 1 && ranking[0].Downloads == 1 {
+			break
+		}
+	}
+
+	if len(ranking) != 1 || ranking[0].Downloads != 1 {
+		t.Fatalf("expected ranked worker to be serving a download, got %+v", ranking)
+	}
+
+	<-done
+	// The download is accounted for until the handler returns, which may be just after the client is done.
+	time.Sleep(50 * time.Millisecond)
+	for _, rank := range p.Ranking() {
+		if rank.Downloads != 0 {
+			t.Fatalf("expected no downloads in progress once finished, got %+v", rank)
+		}
+	}
+}
+
+func TestPool_Replaces_Rules(t *testing.T) {
+	t.Parallel()
+
+	mirror := pooltest.NewMirror(map[string][]byte{testPath: testFile})
+	t.Cleanup(mirror.Close)
+
+	origin := pooltest.NewMirror(map[string][]byte{testPath: testFile})
+	t.Cleanup(origin.Close)
+
+	p := newPool(t, pool.Config{}, pooltest.NewProvider(mirror))
+	server := httptest.NewServer(p)
+	t.Cleanup(server.Close)
+
+	for _, tc := range []struct {
+		name   string
+		rules  rules.Rules
+		status int
+		origin int
+	}{
+		{name: "status", rules: rules.Rules{{Suffix: ".db", Status: http.StatusGone}}, status: http.StatusGone},
+		{name: "pinned", rules: rules.Rules{{Suffix: ".db", Mirror: origin.URL()}}, status: http.StatusOK, origin: 1},
+		{name: "none", rules: rules.Rules{}, status: http.StatusOK, origin: 1},
+	} {
+		err := tc.rules.Compile()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		p.SetRules(tc.rules)
+
+		resp, _ := get(t, server.URL+testPath)
+		if resp.StatusCode != tc.status {
+			t.Fatalf("%s: expected status %d, got %d", tc.name, tc.status, resp.StatusCode)
+		}
+
+		if requests := origin.Requests(); requests != tc.origin {
+			t.Fatalf("%s: expected %d requests to the pinned mirror, got %d", tc.name, tc.origin, requests)
+		}
+	}
+
+	if current := p.CurrentRules(); len(current) != 0 {
+		t.Fatalf("expected rules to be replaced, got %v", current)
+	}
+}
+
+func TestPool_Uses_Fallback_Mirror(t *testing.T) {
+	t.Parallel()
+
+	failing := pooltest.NewMirror(map[string][]byte{testPath: testFile})
+	failing.SetBehavior(pooltest.Behavior{Status: http.StatusServiceUnavailable})
+	t.Cleanup(failing.Close)
+
+	fallback := pooltest.NewMirror(map[string][]byte{testPath: testFile})
+	t.Cleanup(fallback.Close)
+
+	server := newServer(t, pool.Config{Retries: 1, Fallback: fallback.URL()}, pooltest.NewProvider(failing))
+
+	resp, body := get(t, server.URL+testPath)
+	if resp.StatusCode != http.StatusOK || !bytes.Equal(body, testFile) {
+		t.Fatalf("expected file to be served by the fallback mirror, got status %d", resp.StatusCode)
+	}
+
+	if requests := failing.Requests(); requests != 2 {
+		t.Fatalf("expected pool mirror to be tried twice before the fallback, got %d requests", requests)
+	}
+
+	if requests := fallback.Requests(); requests != 1 {
+		t.Fatalf("expected fallback mirror to get 1 request, got %d", requests)
+	}
+}
+
+func TestPool_Serves_Exact_Bytes(t *testing.T) {
+	t.Parallel()
+
+	const peekSize = 1024 * 1024
+
+	random := rand.New(rand.NewSource(1))
+	sizes := []int{0, 1, peekSize - 1, peekSize, peekSize + 1, 3 * peekSize}
+	files := map[string][]byte{}
+	for _, size := range sizes {
+		content := make([]byte, size)
+		_, _ = random.Read(content)
+		files[fmt.Sprintf("/file-%d", size)] = content
+	}
+
+	var mirrors []*pooltest.Mirror
+	for i := 0; i < 3; i++ {
+		mirror := pooltest.NewMirror(files)
+		t.Cleanup(mirror.Close)
+		mirrors = append(mirrors, mirror)
+	}
+
+	server := newServer(t, pool.Config{PeekSizeMiBs: 1, VerifyContentRange: true}, pooltest.NewProvider(mirrors...))
+
+	for _, size := range sizes {
+		size := size
+		path := fmt.Sprintf("/file-%d", size)
+		t.Run(path, func(t *testing.T) {
+			t.Parallel()
+
+			resp, body := get(t, server.URL+path)
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("expected status 200, got %d", resp.StatusCode)
+			}
+
+			if !bytes.Equal(body, files[path]) {
+				t.Fatalf("body of %d bytes does not match file of %d bytes", len(body), size)
+			}
+
+			if size < 2 {
+				return
+			}
+
+			// Ranges starting or ending anywhere must be forwarded and served untouched.
+			req, err := http.NewRequest(http.MethodGet, server.URL+path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-", size/2))
+
+			rangeResp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("requesting range: %v", err)
+			}
+			defer rangeResp.Body.Close()
+
+			rangeBody, err := io.ReadAll(rangeResp.Body)
+			if err != nil {
+				t.Fatalf("reading range body: %v", err)
+			}
+
+			if rangeResp.StatusCode != http.StatusPartialContent || !bytes.Equal(rangeBody, files[path][size/2:]) {
+				t.Fatalf("expected bytes %d- to be served with status 206, got status %d and %d bytes", size/2, rangeResp.StatusCode, len(rangeBody))
+			}
+		})
+	}
+}
@@ -0,0 +1,257 @@
+// Package pooltest provides fake mirrors and providers to test refractor without network access.
+package pooltest
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Behavior controls how a Mirror answers requests.
+type Behavior struct {
+	// Latency is the time the mirror waits before sending response headers.
+	Latency time.Duration
+	// Stall is the time the mirror waits after sending headers and before sending the body.
+	Stall time.Duration
+	// Status, if not zero, is returned for every request instead of the file.
+	Status int
+	// IgnoreRange makes the mirror ignore Range headers and always reply with 200 and the whole file.
+	IgnoreRange bool
+	// TruncateAfter, if greater than zero, makes the mirror drop the connection after sending that amount of bytes
+	// of the body, while still announcing the full Content-Length.
+	TruncateAfter int64
+	// Header is added to the headers of successful responses.
+	Header http.Header
+	// Trailer, if not empty, is declared in the response headers and sent after the body. Range headers are ignored
+	// and the body is sent chunked.
+	Trailer http.Header
+	// Chunked makes the mirror send the body without a Content-Length, so its end is only marked by the last chunk.
+	// Range headers are ignored.
+	Chunked bool
+	// PauseAfter, if greater than zero, makes a Chunked mirror flush that amount of bytes of the body and then wait for
+	// Stall before sending the rest, rather than waiting before sending the body.
+	PauseAfter int64
+}
+
+// Mirror is an HTTP server serving a fixed set of files from memory.
+type Mirror struct {
+	server *httptest.Server
+
+	mu       sync.Mutex
+	files    map[string][]byte
+	behavior Behavior
+	requests int
+	active   int
+}
+
+// NewMirror starts a Mirror serving the given files, keyed by path. The mirror must be closed after use.
+func NewMirror(files map[string][]byte) *Mirror {
+	m := &Mirror{
+		files: files,
+	}
+	m.server = httptest.NewServer(http.HandlerFunc(m.serveHTTP))
+
+	return m
+}
+
+// URL returns the base URL of the mirror.
+func (m *Mirror) URL() string {
+	return m.server.URL
+}
+
+// Close shuts the mirror down. Requests made after Close will fail to connect.
+func (m *Mirror) Close() {
+	m.server.Close()
+}
+
+// SetBehavior replaces the behavior of the mirror for subsequent requests.
+func (m *Mirror) SetBehavior(b Behavior) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.behavior = b
+}
+
+// SetFile replaces the contents served for path by the mirror for subsequent requests.
+func (m *Mirror) SetFile(path string, content []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.files[path] = content
+}
+
+// Active returns the number of requests the mirror is currently serving. Requests are no longer active once the
+// client closes the connection.
+func (m *Mirror) Active() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.active
+}
+
+// Requests returns the number of requests the mirror has received.
+func (m *Mirror) Requests() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.requests
+}
+
+func (m *Mirror) serveHTTP(rw http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	m.requests++
+	m.active++
+	b := m.behavior
+	content, found := m.files[r.URL.Path]
+	m.mu.Unlock()
+
+	defer func() {
+		m.mu.Lock()
+		m.active--
+		m.mu.Unlock()
+	}()
+
+	if !sleep(r, b.Latency) {
+		return
+	}
+
+	if b.Status != 0 {
+		rw.WriteHeader(b.Status)
+		return
+	}
+
+	if !found {
+		rw.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	for name, values := range b.Header {
+		rw.Header()[name] = values
+	}
+
+	if b.IgnoreRange {
+		r.Header.Del("Range")
+	}
+
+	if b.TruncateAfter > 0 && b.TruncateAfter < int64(len(content)) {
+		rw.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		rw.WriteHeader(http.StatusOK)
+		if !sleep(r, b.Stall) {
+			return
+		}
+		_, _ = rw.Write(content[:b.TruncateAfter])
+		if flusher, ok := rw.(http.Flusher); ok {
+			flusher.Flush()
+		}
+		// Aborting the handler closes the connection without completing the body.
+		panic(http.ErrAbortHandler)
+	}
+
+	if len(b.Trailer) > 0 {
+		for name := range b.Trailer {
+			rw.Header().Add("Trailer", name)
+		}
+		rw.WriteHeader(http.StatusOK)
+		_, _ = rw.Write(content)
+		for name, values := range b.Trailer {
+			rw.Header()[name] = values
+		}
+		return
+	}
+
+	if b.Chunked {
+		paused := int64(0)
+		if b.PauseAfter > 0 && b.PauseAfter < int64(len(content)) {
+			paused = b.PauseAfter
+		}
+
+		rw.WriteHeader(http.StatusOK)
+		_, _ = rw.Write(content[:paused])
+		if flusher, ok := rw.(http.Flusher); ok {
+			flusher.Flush()
+		}
+		if !sleep(r, b.Stall) {
+			return
+		}
+		_, _ = rw.Write(content[paused:])
+		return
+	}
+
+	if b.Stall > 0 {
+		rw = &stallWriter{ResponseWriter: rw, request: r, stall: b.Stall}
+	}
+
+	http.ServeContent(rw, r, r.URL.Path, time.Time{}, bytes.NewReader(content))
+}
+
+// sleep waits for the given duration, returning false if the client went away in the meantime.
+func sleep(r *http.Request, d time.Duration) bool {
+	if d == 0 {
+		return true
+	}
+
+	select {
+	case <-time.After(d):
+		return true
+	case <-r.Context().Done():
+		return false
+	}
+}
+
+// stallWriter flushes headers and waits for some time before the first write to the body.
+type stallWriter struct {
+	http.ResponseWriter
+	request *http.Request
+	stall   time.Duration
+	stalled bool
+}
+
+func (sw *stallWriter) Write(buf []byte) (int, error) {
+	if !sw.stalled {
+		sw.stalled = true
+		if flusher, ok := sw.ResponseWriter.(http.Flusher); ok {
+			flusher.Flush()
+		}
+
+		if !sleep(sw.request, sw.stall) {
+			return 0, sw.request.Context().Err()
+		}
+	}
+
+	return sw.ResponseWriter.Write(buf)
+}
+
+// Provider is a types.Provider that cycles through a fixed list of mirrors.
+type Provider struct {
+	mu   sync.Mutex
+	urls []string
+	next int
+}
+
+// NewProvider returns a Provider that cycles through the supplied mirrors, in order.
+func NewProvider(mirrors ...*Mirror) *Provider {
+	p := &Provider{}
+	for _, m := range mirrors {
+		p.urls = append(p.urls, m.URL())
+	}
+
+	return p
+}
+
+func (p *Provider) Mirror() (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.urls) == 0 {
+		return "", fmt.Errorf("no mirrors to provide")
+	}
+
+	url := p.urls[p.next%len(p.urls)]
+	p.next++
+
+	return url, nil
+}
@@ -0,0 +1,83 @@
+package pool
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+)
+
+// PreloadResult reports how preloading a path into the cache went.
+type PreloadResult struct {
+	Path string `json:"path"`
+	// Status is the status the pool answered with, or zero if no response could be produced at all.
+	Status int `json:"status,omitempty"`
+	// Error describes why the path was not preloaded, if it was not.
+	Error string `json:"error,omitempty"`
+}
+
+// Preload downloads paths through the pool, as Fetch does, so they are stored in the cache before clients request
+// them, e.g. during a maintenance window. At most concurrency paths are downloaded at the same time. Paths the cache
+// would not store are skipped, and those already cached are not downloaded again. It returns the result for each
+// path, in the same order, and an error if the pool has no cache.
+func (p *Pool) Preload(ctx context.Context, paths []string, concurrency int) ([]PreloadResult, error) {
+	if p.Cache == nil {
+		return nil, fmt.Errorf("preloading requires a cache")
+	}
+
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	results := make([]PreloadResult, len(paths))
+	sem := make(chan struct{}, concurrency)
+	wg := sync.WaitGroup{}
+	for i, path := range paths {
+		results[i].Path = path
+		if !p.Cache.Cacheable(path) {
+			results[i].Error = "not cacheable"
+			continue
+		}
+
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			results[i].Error = ctx.Err().Error()
+			continue
+		}
+
+		wg.Add(1)
+		go func(result *PreloadResult) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			p.preload(ctx, result)
+		}(&results[i])
+	}
+
+	wg.Wait()
+	return results, nil
+}
+
+// preload downloads result.Path, discarding the body, and fills result with the outcome.
+func (p *Pool) preload(ctx context.Context, result *PreloadResult) {
+	resp, err := p.Fetch(ctx, result.Path, nil)
+	if err != nil {
+		result.Error = err.Error()
+		return
+	}
+	defer resp.Body.Close()
+
+	result.Status = resp.StatusCode
+	if resp.StatusCode != http.StatusOK {
+		result.Error = fmt.Sprintf("pool answered with status %d", resp.StatusCode)
+		return
+	}
+
+	// Files are committed to the cache once the body has been read in full.
+	_, err = io.Copy(io.Discard, resp.Body)
+	if err != nil {
+		result.Error = fmt.Sprintf("reading body: %v", err)
+	}
+}
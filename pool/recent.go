@@ -0,0 +1,33 @@
+package pool
+
+import "sync"
+
+// maxRecentErrors is the number of failed requests kept for the status endpoint.
+const maxRecentErrors = 20
+
+// recentErrors keeps the records of the last requests that failed, oldest first.
+type recentErrors struct {
+	mtx     sync.Mutex
+	records []AuditRecord
+}
+
+func (re *recentErrors) add(record AuditRecord) {
+	if record.Error == "" {
+		return
+	}
+
+	re.mtx.Lock()
+	defer re.mtx.Unlock()
+
+	re.records = append(re.records, record)
+	if len(re.records) > maxRecentErrors {
+		re.records = re.records[len(re.records)-maxRecentErrors:]
+	}
+}
+
+func (re *recentErrors) list() []AuditRecord {
+	re.mtx.Lock()
+	defer re.mtx.Unlock()
+
+	return append([]AuditRecord{}, re.records...)
+}
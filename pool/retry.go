@@ -0,0 +1,44 @@
+package pool
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// errMirrorFailed is wrapped by errors returned when a mirror could not be asked for a file at all, e.g. because it
+// could not be reached.
+var errMirrorFailed = errors.New("errored")
+
+// StatusError is the error passed to Config.IsRetryable when a mirror answers with a status that the StatusPolicy
+// says should be retried.
+type StatusError struct {
+	Status int
+	// Listed is set if the StatusPolicy lists Status as retried or evicting, rather than retrying it by default.
+	Listed bool
+}
+
+func (e StatusError) Error() string {
+	return fmt.Sprintf("non-200 status: %d", e.Status)
+}
+
+// DefaultIsRetryable is the retry classification used when Config.IsRetryable is not set. It retries timeouts,
+// connection errors and 5xx statuses, as a different mirror is likely to succeed, but not 4xx statuses, which other
+// mirrors would likely answer the same and are passed to the client. Statuses explicitly listed by the StatusPolicy as retried or evicting are
+// always retried, as are bodies that are truncated, too slow or corrupt, which are the fault of the mirror.
+func DefaultIsRetryable(err error, _ *http.Response) bool {
+	var statusErr StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.Listed || statusErr.Status >= 500
+	}
+
+	return true
+}
+
+func (p *Pool) isRetryable(err error, response *http.Response) bool {
+	if p.IsRetryable == nil {
+		return DefaultIsRetryable(err, response)
+	}
+
+	return p.IsRetryable(err, response)
+}
@@ -0,0 +1,74 @@
+package pool
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"reflect"
+	"roob.re/refractor/worker"
+	"testing"
+)
+
+func TestDefaultIsRetryable(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name      string
+		err       error
+		retryable bool
+	}{
+		{name: "5xx", err: fmt.Errorf("mirror returned %w", StatusError{Status: 503}), retryable: true},
+		{name: "4xx", err: fmt.Errorf("mirror returned %w", StatusError{Status: 404}), retryable: false},
+		{name: "listed 4xx", err: fmt.Errorf("mirror returned %w", StatusError{Status: 404, Listed: true}), retryable: true},
+		{name: "connection error", err: fmt.Errorf("mirror %w: connection refused", errMirrorFailed), retryable: true},
+		{name: "timeout", err: fmt.Errorf("peeking: %w", context.DeadlineExceeded), retryable: true},
+		{name: "truncated", err: fmt.Errorf("peeking: %w", io.ErrUnexpectedEOF), retryable: true},
+		{name: "slow", err: fmt.Errorf("peeking: %w", errTooSlow), retryable: true},
+		{name: "corrupt", err: fmt.Errorf("verifying: %w", errDigestMismatch), retryable: true},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			if retryable := DefaultIsRetryable(tc.err, nil); retryable != tc.retryable {
+				t.Fatalf("expected retryable to be %v for %v", tc.retryable, tc.err)
+			}
+		})
+	}
+}
+
+func TestPool_Excludes_Tried_Workers(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name     string
+		workers  []string
+		tried    []string
+		excluded []string
+	}{
+		{name: "none tried", workers: []string{"a", "b"}},
+		{name: "tried once", workers: []string{"a", "b"}, tried: []string{"a"}, excluded: []string{"a"}},
+		{name: "tried twice", workers: []string{"a", "b"}, tried: []string{"a", "a"}, excluded: []string{"a"}},
+		{name: "evicted", workers: []string{"b", "c"}, tried: []string{"a", "b"}, excluded: []string{"b"}},
+		{name: "all tried", workers: []string{"a", "b"}, tried: []string{"a", "b", "a"}},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			p := &Pool{workers: map[string]worker.Worker{}}
+			for _, name := range tc.workers {
+				p.workers[name] = worker.Worker{}
+			}
+
+			dl := &download{}
+			for _, name := range tc.tried {
+				dl.try(name)
+			}
+
+			if excluded := p.excludedWorkers(dl); !reflect.DeepEqual(excluded, tc.excluded) {
+				t.Fatalf("expected %v to be excluded, got %v", tc.excluded, excluded)
+			}
+		})
+	}
+}
@@ -0,0 +1,56 @@
+package pool
+
+import (
+	log "github.com/sirupsen/logrus"
+	"roob.re/refractor/client"
+	"roob.re/refractor/rules"
+)
+
+// ruleSet holds the rules used by the pool, along with a client for each mirror they pin paths to.
+type ruleSet struct {
+	rules  rules.Rules
+	pinned map[string]*client.Client // Keyed by mirror URL.
+}
+
+func (p *Pool) currentRules() *ruleSet {
+	return p.ruleSet.Load().(*ruleSet)
+}
+
+// CurrentRules returns the rules currently in use, which may differ from Config.Rules if they were replaced.
+func (p *Pool) CurrentRules() rules.Rules {
+	return p.currentRules().rules
+}
+
+// SetRules replaces the rules used by the pool, which must be compiled. Requests in progress keep using the rules they
+// started with.
+func (p *Pool) SetRules(rs rules.Rules) {
+	var old *ruleSet
+	if current, ok := p.ruleSet.Load().(*ruleSet); ok {
+		old = current
+	}
+
+	next := &ruleSet{rules: rs, pinned: map[string]*client.Client{}}
+	for _, mirror := range rs.Mirrors() {
+		// Clients for mirrors that are still pinned are kept, along with their connections.
+		if old != nil && old.pinned[mirror] != nil {
+			next.pinned[mirror] = old.pinned[mirror]
+			continue
+		}
+
+		next.pinned[mirror] = client.NewClient(p.clientConfig, mirror)
+	}
+
+	p.ruleSet.Store(next)
+
+	if old == nil {
+		return
+	}
+
+	log.Infof("Replaced rules, %d are now in use", len(rs))
+	for mirror, c := range old.pinned {
+		if next.pinned[mirror] == nil {
+			// Requests in progress can still use the client, only idle connections are closed.
+			c.Close()
+		}
+	}
+}
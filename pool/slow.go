@@ -0,0 +1,91 @@
+package pool
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaultThroughputWindow is used when Config.MinThroughputMiBs is set but Config.ThroughputWindow is not.
+const defaultThroughputWindow = 10 * time.Second
+
+var errTooSlow = errors.New("mirror throughput below minimum")
+
+// watchedBody fails reads with errTooSlow once less than min bytes have been read during a window. The body is
+// closed when that happens, so reads blocked on a stalled mirror are also interrupted.
+type watchedBody struct {
+	io.ReadCloser
+	read    int64 // accessed atomically
+	tooSlow int32 // accessed atomically
+
+	done     chan struct{}
+	doneOnce sync.Once
+}
+
+// watchBody wraps body so reads fail with errTooSlow if it is read slower than minMiBs over a window. Time spent
+// waiting on bandwidth limits, as recorded by throttled, is not counted towards the window.
+func watchBody(body io.ReadCloser, minMiBs float64, window time.Duration, throttled *throttleClock) io.ReadCloser {
+	if minMiBs <= 0 {
+		return body
+	}
+
+	if window <= 0 {
+		window = defaultThroughputWindow
+	}
+
+	wb := &watchedBody{ReadCloser: body, done: make(chan struct{})}
+	go wb.watch(minMiBs*1024*1024, window, throttled)
+
+	return wb
+}
+
+func (wb *watchedBody) watch(minBytesPerSecond float64, window time.Duration, throttled *throttleClock) {
+	ticker := time.NewTicker(window)
+	defer ticker.Stop()
+
+	waited := throttled.total()
+	for {
+		select {
+		case <-wb.done:
+			return
+		case <-ticker.C:
+			previous := waited
+			waited = throttled.total()
+			active := window - (waited - previous)
+			if atomic.SwapInt64(&wb.read, 0) < int64(minBytesPerSecond*active.Seconds()) {
+				atomic.StoreInt32(&wb.tooSlow, 1)
+				_ = wb.Close()
+				return
+			}
+		}
+	}
+}
+
+func (wb *watchedBody) Read(buf []byte) (int, error) {
+	n, err := wb.ReadCloser.Read(buf)
+	atomic.AddInt64(&wb.read, int64(n))
+
+	if atomic.LoadInt32(&wb.tooSlow) == 1 {
+		return n, errTooSlow
+	}
+
+	if err != nil {
+		// Nothing else to watch once the body has been consumed.
+		wb.stop()
+	}
+
+	return n, err
+}
+
+func (wb *watchedBody) Close() error {
+	wb.stop()
+	return wb.ReadCloser.Close()
+}
+
+func (wb *watchedBody) stop() {
+	wb.doneOnce.Do(func() {
+		close(wb.done)
+	})
+}
@@ -0,0 +1,57 @@
+package pool
+
+import "golang.org/x/exp/slices"
+
+// StatusPolicy controls what happens when a mirror answers with a given status code. Codes not listed anywhere are
+// passed through to the client if they are below 400, and otherwise left to Config.IsRetryable, which by default
+// retries 5xx codes on a different worker and passes 4xx ones through. If Evict is not set, 401 and 403 also evict the
+// mirror.
+type StatusPolicy struct {
+	// Pass lists status codes that are returned to the client as sent by the mirror.
+	Pass []int `yaml:"pass"`
+	// Retry lists status codes that cause the request to be retried on a different worker.
+	Retry []int `yaml:"retry"`
+	// Fail lists status codes that cause the request to fail immediately with 502 Bad Gateway.
+	Fail []int `yaml:"fail"`
+	// Evict lists status codes that cause the mirror to be evicted from the pool, and the request retried on a
+	// different worker. This is meant for mirrors that are not expected to recover soon, like those rejecting
+	// expired credentials.
+	Evict []int `yaml:"evict"`
+}
+
+// defaultEvict contains the status codes that evict mirrors if StatusPolicy.Evict is not set.
+var defaultEvict = []int{401, 403}
+
+type statusAction int
+
+const (
+	statusPass statusAction = iota
+	statusRetry
+	statusFail
+	statusEvict
+)
+
+// listed returns whether status is retried or evicts the mirror because the policy says so, rather than by default.
+func (sp StatusPolicy) listed(status int) bool {
+	return slices.Contains(sp.Evict, status) || slices.Contains(sp.Retry, status) ||
+		(sp.Evict == nil && slices.Contains(defaultEvict, status))
+}
+
+func (sp StatusPolicy) action(status int) statusAction {
+	switch {
+	case slices.Contains(sp.Fail, status):
+		return statusFail
+	case slices.Contains(sp.Evict, status):
+		return statusEvict
+	case slices.Contains(sp.Retry, status):
+		return statusRetry
+	case slices.Contains(sp.Pass, status):
+		return statusPass
+	case sp.Evict == nil && slices.Contains(defaultEvict, status):
+		return statusEvict
+	case status >= 400:
+		return statusRetry
+	default:
+		return statusPass
+	}
+}
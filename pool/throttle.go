@@ -0,0 +1,206 @@
+package pool
+
+import (
+	"context"
+	"fmt"
+	"golang.org/x/time/rate"
+	"io"
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// throttleBurstBytes is the largest amount of bytes read from a throttled mirror at once.
+const throttleBurstBytes = 64 * 1024
+
+// BandwidthLimit caps the rate at which files are downloaded from mirrors whose URL matches a regular expression.
+type BandwidthLimit struct {
+	// Mirror is a regular expression matched against the mirror URL. If empty, the limit applies to all mirrors.
+	Mirror string `yaml:"mirror"`
+	// MiBs is the maximum throughput, in MiB/s, shared by all requests being served by a matching mirror.
+	MiBs float64 `yaml:"mibs"`
+
+	mirror *regexp.Regexp
+}
+
+func (bl *BandwidthLimit) compile() error {
+	if bl.MiBs <= 0 {
+		return fmt.Errorf("bandwidth limit must be positive")
+	}
+
+	if bl.Mirror != "" {
+		var err error
+		bl.mirror, err = regexp.Compile(bl.Mirror)
+		if err != nil {
+			return fmt.Errorf("compiling mirror regex: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func (bl *BandwidthLimit) appliesTo(mirror string) bool {
+	return bl.mirror == nil || bl.mirror.MatchString(mirror)
+}
+
+// BandwidthLimits is a list of bandwidth limits. The first one matching a mirror applies to it.
+type BandwidthLimits []BandwidthLimit
+
+// Compile validates the limits and prepares them to be matched against mirrors. It must be called before creating
+// the pool.
+func (bls BandwidthLimits) Compile() error {
+	for i := range bls {
+		err := bls[i].compile()
+		if err != nil {
+			return fmt.Errorf("bandwidth limit #%d: %w", i, err)
+		}
+	}
+
+	return nil
+}
+
+// throttles holds a token bucket for each mirror that has a bandwidth limit, so the limit is shared by all the
+// requests served by that mirror.
+type throttles struct {
+	mtx      sync.Mutex
+	limits   BandwidthLimits
+	limiters map[string]*rate.Limiter
+}
+
+// limiter returns the limiter for mirror, or nil if mirror is not limited.
+func (t *throttles) limiter(mirror string) *rate.Limiter {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	if limiter, found := t.limiters[mirror]; found {
+		return limiter
+	}
+
+	var limiter *rate.Limiter
+	for i := range t.limits {
+		if t.limits[i].appliesTo(mirror) {
+			limiter = newLimiter(t.limits[i].MiBs)
+			break
+		}
+	}
+
+	if t.limiters == nil {
+		t.limiters = map[string]*rate.Limiter{}
+	}
+	t.limiters[mirror] = limiter
+
+	return limiter
+}
+
+// forget drops the limiter for mirror, so it is created again from the limits if needed.
+func (t *throttles) forget(mirror string) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	delete(t.limiters, mirror)
+}
+
+// body wraps body so it is read no faster than the limit for mirror allows. Time spent waiting is added to clock.
+func (t *throttles) body(ctx context.Context, mirror string, body io.ReadCloser, clock *throttleClock) io.ReadCloser {
+	return throttle(ctx, t.limiter(mirror), body, clock)
+}
+
+// throttle wraps body so it is read no faster than limiter allows. If limiter is nil, body is returned as is.
+func throttle(ctx context.Context, limiter *rate.Limiter, body io.ReadCloser, clock *throttleClock) io.ReadCloser {
+	if limiter == nil {
+		return body
+	}
+
+	return &throttledBody{ReadCloser: body, ctx: ctx, limiter: limiter, clock: clock}
+}
+
+// newLimiter returns a limiter allowing up to mibs MiB/s, or nil if mibs is not positive.
+func newLimiter(mibs float64) *rate.Limiter {
+	if mibs <= 0 {
+		return nil
+	}
+
+	return rate.NewLimiter(rate.Limit(mibs*1024*1024), throttleBurstBytes)
+}
+
+// throttleClock adds up the time spent waiting on bandwidth limits during an attempt, so it is not mistaken for the
+// mirror being slow. A nil clock discards it.
+type throttleClock struct {
+	waited int64 // Nanoseconds, accessed atomically.
+}
+
+// wait waits until limiter allows n bytes, and records the time it took.
+func (tc *throttleClock) wait(ctx context.Context, limiter *rate.Limiter, n int) error {
+	start := time.Now()
+	err := limiter.WaitN(ctx, n)
+	if tc != nil {
+		atomic.AddInt64(&tc.waited, int64(time.Since(start)))
+	}
+
+	return err
+}
+
+func (tc *throttleClock) total() time.Duration {
+	if tc == nil {
+		return 0
+	}
+
+	return time.Duration(atomic.LoadInt64(&tc.waited))
+}
+
+// throttledWriter writes no faster than limiter allows.
+type throttledWriter struct {
+	io.Writer
+	ctx     context.Context
+	limiter *rate.Limiter
+	clock   *throttleClock
+}
+
+func (tw *throttledWriter) Write(buf []byte) (int, error) {
+	written := 0
+	for len(buf) > 0 {
+		chunk := buf
+		if len(chunk) > tw.limiter.Burst() {
+			chunk = chunk[:tw.limiter.Burst()]
+		}
+
+		err := tw.clock.wait(tw.ctx, tw.limiter, len(chunk))
+		if err != nil {
+			return written, err
+		}
+
+		n, err := tw.Writer.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+
+		buf = buf[n:]
+	}
+
+	return written, nil
+}
+
+type throttledBody struct {
+	io.ReadCloser
+	ctx     context.Context
+	limiter *rate.Limiter
+	clock   *throttleClock
+}
+
+func (tb *throttledBody) Read(buf []byte) (int, error) {
+	if len(buf) > tb.limiter.Burst() {
+		buf = buf[:tb.limiter.Burst()]
+	}
+
+	n, err := tb.ReadCloser.Read(buf)
+	if n > 0 {
+		waitErr := tb.clock.wait(tb.ctx, tb.limiter, n)
+		if waitErr != nil && err == nil {
+			err = waitErr
+		}
+	}
+
+	return n, err
+}
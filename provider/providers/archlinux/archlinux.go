@@ -7,22 +7,44 @@ import (
 	"math/rand"
 	"net/http"
 	"roob.re/refractor/provider/types"
-	"strings"
 	"time"
 )
 
-const mirrorsUrl = "https://archlinux.org/mirrors/status/json/"
+const (
+	mirrorsUrl             = "https://archlinux.org/mirrors/status/json/"
+	defaultRefreshInterval = time.Hour
+)
+
+// httpClient fetches the mirror status. A timeout prevents a hanging request from stopping mirrors from being fed to
+// the pool.
+var httpClient = &http.Client{Timeout: 30 * time.Second}
 
 type config struct {
+	// URL is where the mirror status JSON is fetched from. Defaults to the official Arch Linux mirror status.
+	URL           string   `yaml:"url"`
 	CountriesList []string `yaml:"countries"`
 	MaxScore      float64  `yaml:"maxScore"`
+	// MinCompletion is the minimum fraction, between 0 and 1, of successful checks a mirror must have had.
+	MinCompletion float64 `yaml:"minCompletion"`
+	// MaxDelay is the maximum time a mirror can lag behind the master mirror.
+	MaxDelay time.Duration `yaml:"maxDelay"`
+	// Weighted makes mirrors with better (lower) scores more likely to be fed to the pool.
+	Weighted bool `yaml:"weighted"`
+	// Protocols lists the protocols mirrors must be reachable with. Defaults to http and https.
+	Protocols []string `yaml:"protocols"`
+	// RefreshInterval is how often the mirror status is fetched again. Defaults to an hour.
+	RefreshInterval time.Duration `yaml:"refreshInterval"`
 
 	countries map[string]bool
+	protocols map[string]bool
 }
 
 type Provider struct {
 	config
 
+	// drainer, if set, takes mirrors that are no longer listed after a refresh out of the pool.
+	drainer types.Drainer
+
 	mirrorlist struct {
 		list    []mirror
 		fetched time.Time
@@ -41,13 +63,31 @@ func New(conf interface{}) (types.Provider, error) {
 		acConfig.countries[country] = true
 	}
 
+	if len(acConfig.Protocols) == 0 {
+		acConfig.Protocols = []string{"http", "https"}
+	}
+
+	acConfig.protocols = map[string]bool{}
+	for _, protocol := range acConfig.Protocols {
+		if protocol != "http" && protocol != "https" {
+			return nil, fmt.Errorf("unsupported protocol %q, only http and https can be used", protocol)
+		}
+		acConfig.protocols[protocol] = true
+	}
+
+	if acConfig.RefreshInterval <= 0 {
+		acConfig.RefreshInterval = defaultRefreshInterval
+	}
+
 	return &Provider{
 		config: *acConfig,
 	}, nil
 }
 
 func DefaultConfig() interface{} {
-	return &config{}
+	return &config{
+		URL: mirrorsUrl,
+	}
 }
 
 type mirror struct {
@@ -55,16 +95,24 @@ type mirror struct {
 	Country  string  `json:"country_code"`
 	Protocol string  `json:"protocol"`
 	URL      string  `json:"url"`
+	// Completion and Delay, in seconds, are null for mirrors that have not been checked recently.
+	Completion *float64 `json:"completion_pct"`
+	Delay      *int64   `json:"delay"`
 }
 
 func (m *mirror) String() string {
 	return fmt.Sprintf("score=%.2f country=%s url=%s", m.Score, m.Country, m.URL)
 }
 
+// weight is proportional to the likelihood of the mirror being picked when weighted selection is enabled.
+func (m *mirror) weight() float64 {
+	return 1 / (1 + m.Score)
+}
+
 func (a *Provider) filter(all []mirror) []mirror {
 	list := make([]mirror, 0, len(all)/4)
 	for _, mirror := range all {
-		if !strings.Contains(mirror.Protocol, "http") {
+		if !a.protocols[mirror.Protocol] {
 			continue
 		}
 
@@ -76,6 +124,14 @@ func (a *Provider) filter(all []mirror) []mirror {
 			continue
 		}
 
+		if a.MinCompletion > 0 && (mirror.Completion == nil || *mirror.Completion < a.MinCompletion) {
+			continue
+		}
+
+		if a.MaxDelay > 0 && (mirror.Delay == nil || time.Duration(*mirror.Delay)*time.Second > a.MaxDelay) {
+			continue
+		}
+
 		list = append(list, mirror)
 	}
 
@@ -83,16 +139,62 @@ func (a *Provider) filter(all []mirror) []mirror {
 }
 
 func (a *Provider) mirrors() ([]mirror, error) {
-	if time.Since(a.mirrorlist.fetched) < time.Hour {
+	if time.Since(a.mirrorlist.fetched) < a.RefreshInterval {
 		return a.mirrorlist.list, nil
 	}
 
-	log.Infof("Requesting mirrorlist from %s", mirrorsUrl)
-	resp, err := http.Get(mirrorsUrl)
+	list, err := a.fetch()
+	if err != nil && a.mirrorlist.list != nil {
+		// A stale list is better than no mirrors at all. It will be refreshed again after the interval.
+		log.Warnf("Refreshing mirrorlist, using previous one: %v", err)
+		a.mirrorlist.fetched = time.Now()
+		return a.mirrorlist.list, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	log.Infof("Fetched mirrorlist with %d mirrors matching filters", len(list))
+	a.drainVanished(a.mirrorlist.list, list)
+	a.mirrorlist.list = list
+	a.mirrorlist.fetched = time.Now()
+
+	return list, nil
+}
+
+// SetDrainer implements types.DrainingProvider.
+func (a *Provider) SetDrainer(drainer types.Drainer) {
+	a.drainer = drainer
+}
+
+// drainVanished drains the workers of mirrors in previous that are not in current, as they have been removed from the
+// status or stopped matching the filters since the previous refresh.
+func (a *Provider) drainVanished(previous, current []mirror) {
+	if a.drainer == nil {
+		return
+	}
+
+	listed := map[string]bool{}
+	for _, mirror := range current {
+		listed[mirror.URL] = true
+	}
+
+	for _, mirror := range previous {
+		if !listed[mirror.URL] && a.drainer.DrainMirror(mirror.URL) {
+			log.Infof("Draining %s, which is no longer listed", mirror.URL)
+		}
+	}
+}
+
+func (a *Provider) fetch() ([]mirror, error) {
+	log.Infof("Requesting mirrorlist from %s", a.URL)
+	resp, err := httpClient.Get(a.URL)
 	if err != nil {
 		return nil, fmt.Errorf("fetching mirrorlist: %w", err)
 	}
 
+	defer resp.Body.Close()
+
 	if resp.StatusCode != 200 {
 		return nil, fmt.Errorf("wrong status code %d", resp.StatusCode)
 	}
@@ -107,12 +209,7 @@ func (a *Provider) mirrors() ([]mirror, error) {
 		return nil, fmt.Errorf("decoding json: %w", err)
 	}
 
-	list := a.filter(response.Mirrors)
-
-	a.mirrorlist.list = list
-	a.mirrorlist.fetched = time.Now()
-
-	return list, nil
+	return a.filter(response.Mirrors), nil
 }
 
 func (a *Provider) Mirror() (string, error) {
@@ -121,8 +218,33 @@ func (a *Provider) Mirror() (string, error) {
 		return "", fmt.Errorf("accessing mirrorlist: %w", err)
 	}
 
-	mirror := list[rand.Int63n(int64(len(list)))]
+	if len(list) == 0 {
+		return "", fmt.Errorf("no mirrors match the configured filters")
+	}
+
+	mirror := a.pick(list)
 	log.Infof("Mirror fed to pool: %s", mirror.String())
 
 	return mirror.URL, nil
 }
+
+func (a *Provider) pick(list []mirror) mirror {
+	if !a.Weighted {
+		return list[rand.Int63n(int64(len(list)))]
+	}
+
+	total := 0.0
+	for i := range list {
+		total += list[i].weight()
+	}
+
+	target := rand.Float64() * total
+	for i := range list {
+		target -= list[i].weight()
+		if target < 0 {
+			return list[i]
+		}
+	}
+
+	return list[len(list)-1]
+}
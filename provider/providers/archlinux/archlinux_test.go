@@ -0,0 +1,200 @@
+package archlinux
+
+import (
+	"encoding/json"
+	"golang.org/x/exp/slices"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func float(f float64) *float64 {
+	return &f
+}
+
+func seconds(s int64) *int64 {
+	return &s
+}
+
+func newProvider(t *testing.T, conf config) *Provider {
+	t.Helper()
+
+	provider, err := New(&conf)
+	if err != nil {
+		t.Fatalf("creating provider: %v", err)
+	}
+
+	return provider.(*Provider)
+}
+
+func urls(mirrors []mirror) []string {
+	list := make([]string, 0, len(mirrors))
+	for _, mirror := range mirrors {
+		list = append(list, mirror.URL)
+	}
+
+	return list
+}
+
+func TestProvider_Filter(t *testing.T) {
+	t.Parallel()
+
+	all := []mirror{
+		{URL: "http://fast.example/", Protocol: "http", Country: "ES", Score: 1, Completion: float(1), Delay: seconds(60)},
+		{URL: "https://slow.example/", Protocol: "https", Country: "DE", Score: 10, Completion: float(0.5), Delay: seconds(7200)},
+		{URL: "rsync://rsync.example/", Protocol: "rsync", Country: "ES", Score: 1, Completion: float(1), Delay: seconds(60)},
+		{URL: "https://unchecked.example/", Protocol: "https", Country: "ES", Score: 2},
+	}
+
+	for _, tc := range []struct {
+		name     string
+		config   config
+		expected []string
+	}{
+		{
+			name:     "default protocols",
+			expected: []string{"http://fast.example/", "https://slow.example/", "https://unchecked.example/"},
+		},
+		{
+			name:     "https only",
+			config:   config{Protocols: []string{"https"}},
+			expected: []string{"https://slow.example/", "https://unchecked.example/"},
+		},
+		{
+			name:     "countries",
+			config:   config{CountriesList: []string{"DE"}},
+			expected: []string{"https://slow.example/"},
+		},
+		{
+			name:     "max score",
+			config:   config{MaxScore: 5},
+			expected: []string{"http://fast.example/", "https://unchecked.example/"},
+		},
+		{
+			name:     "min completion",
+			config:   config{MinCompletion: 0.9},
+			expected: []string{"http://fast.example/"},
+		},
+		{
+			name:     "max delay",
+			config:   config{MaxDelay: time.Hour},
+			expected: []string{"http://fast.example/"},
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			provider := newProvider(t, tc.config)
+			if filtered := urls(provider.filter(all)); !slices.Equal(filtered, tc.expected) {
+				t.Fatalf("expected %v, got %v", tc.expected, filtered)
+			}
+		})
+	}
+}
+
+// statusServer serves a mirror status with the given mirrors, or fails if failing is set.
+type statusServer struct {
+	mtx     sync.Mutex
+	mirrors []mirror
+	failing bool
+}
+
+func (ss *statusServer) set(mirrors []mirror, failing bool) {
+	ss.mtx.Lock()
+	defer ss.mtx.Unlock()
+
+	ss.mirrors = mirrors
+	ss.failing = failing
+}
+
+func (ss *statusServer) ServeHTTP(rw http.ResponseWriter, _ *http.Request) {
+	ss.mtx.Lock()
+	defer ss.mtx.Unlock()
+
+	if ss.failing {
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	_ = json.NewEncoder(rw).Encode(map[string]interface{}{"version": 3, "urls": ss.mirrors})
+}
+
+type drainer struct {
+	drained []string
+}
+
+func (d *drainer) DrainMirror(mirror string) bool {
+	d.drained = append(d.drained, mirror)
+	return true
+}
+
+func TestProvider_Refreshes_Mirrorlist(t *testing.T) {
+	t.Parallel()
+
+	first := []mirror{
+		{URL: "https://one.example/", Protocol: "https"},
+		{URL: "https://two.example/", Protocol: "https"},
+	}
+	second := []mirror{
+		{URL: "https://two.example/", Protocol: "https"},
+		{URL: "https://three.example/", Protocol: "https"},
+	}
+
+	for _, tc := range []struct {
+		name     string
+		failing  bool
+		expected []string
+		drained  []string
+	}{
+		{
+			name:     "refreshed",
+			expected: []string{"https://two.example/", "https://three.example/"},
+			drained:  []string{"https://one.example/"},
+		},
+		{
+			name:     "stale on failure",
+			failing:  true,
+			expected: []string{"https://one.example/", "https://two.example/"},
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			status := &statusServer{}
+			status.set(first, false)
+			server := httptest.NewServer(status)
+			t.Cleanup(server.Close)
+
+			d := &drainer{}
+			provider := newProvider(t, config{URL: server.URL, RefreshInterval: time.Millisecond})
+			provider.SetDrainer(d)
+
+			list, err := provider.mirrors()
+			if err != nil {
+				t.Fatalf("fetching mirrorlist: %v", err)
+			}
+			if !slices.Equal(urls(list), urls(first)) {
+				t.Fatalf("expected %v, got %v", urls(first), urls(list))
+			}
+
+			status.set(second, tc.failing)
+			time.Sleep(5 * time.Millisecond)
+
+			list, err = provider.mirrors()
+			if err != nil {
+				t.Fatalf("refreshing mirrorlist: %v", err)
+			}
+			if !slices.Equal(urls(list), tc.expected) {
+				t.Fatalf("expected %v, got %v", tc.expected, urls(list))
+			}
+
+			if !slices.Equal(d.drained, tc.drained) {
+				t.Fatalf("expected %v to be drained, got %v", tc.drained, d.drained)
+			}
+		})
+	}
+}
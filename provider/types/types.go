@@ -8,6 +8,21 @@ type Provider interface {
 	Mirror() (string, error)
 }
 
+// Drainer can take the workers serving a mirror out of the pool. It is implemented by pool.Pool.
+type Drainer interface {
+	// DrainMirror evicts the workers assigned to mirror once they finish their current requests. It returns false if
+	// no worker is assigned to it.
+	DrainMirror(mirror string) bool
+}
+
+// DrainingProvider is implemented by providers whose list of mirrors changes over time, so mirrors that are no longer
+// listed can be taken out of the pool rather than kept until they are rotated out.
+type DrainingProvider interface {
+	Provider
+	// SetDrainer is called by pool.Pool before it starts feeding mirrors from the provider.
+	SetDrainer(Drainer)
+}
+
 // Builder contains two functions needed for server.Server to build a provider.
 type Builder struct {
 	// DefaultConfig is expected to return a pointer to an empty struct, which is a provider-specific config.
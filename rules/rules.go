@@ -0,0 +1,187 @@
+// Package rules implements path-based rules that override how refractor handles certain requests.
+package rules
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Default contains the rules used when none are configured.
+var Default = Rules{
+	// Archlinux mirrors are expected to return 404 for database signatures, so there is no point on asking them.
+	{Suffix: ".db.sig", Status: 404},
+}
+
+// Profiles contains the rules used when none are configured for each of the supported distributions.
+var Profiles = map[string]Rules{
+	"archlinux": Default,
+	// Debian and Fedora mirrors have no known quirks to work around.
+	"debian": {},
+	"fedora": {},
+}
+
+// Rule matches request paths either by suffix or by regular expression, and defines what to do with them.
+type Rule struct {
+	// Suffix matches paths ending with the given string.
+	Suffix string `yaml:"suffix,omitempty"`
+	// Regex matches paths against a regular expression.
+	Regex string `yaml:"regex,omitempty"`
+
+	// Status makes refractor answer matching requests with the given status code, without contacting any mirror.
+	Status int `yaml:"status,omitempty"`
+	// Body is sent to the client along with Status.
+	Body string `yaml:"body,omitempty"`
+
+	// Class tags matching requests, so their throughput can be reported separately, e.g. packages and isos. Rules
+	// defining only a class do not change how requests are handled.
+	Class string `yaml:"class,omitempty"`
+
+	// Mirror makes refractor request matching paths from this mirror only, bypassing the pool. This suits files that
+	// must be consistent with each other, like repository databases, which are best fetched from a single mirror known
+	// to be up to date.
+	Mirror string `yaml:"mirror,omitempty"`
+
+	// Policy overrides how matching requests are retried. Fields left unset default to the pool configuration.
+	Policy Policy `yaml:",inline"`
+
+	regex *regexp.Regexp
+}
+
+// Policy controls how many times and for how long a request is retried. Fields are pointers so they can be set to
+// zero, e.g. to disable retries or the request timeout, while nil ones are left to the pool configuration.
+type Policy struct {
+	// Retries overrides how many times a request is retried on a different worker.
+	Retries *int `yaml:"retries,omitempty"`
+	// RequestTimeout overrides the limit for the whole handling of a request, including retries. Zero disables it.
+	RequestTimeout *time.Duration `yaml:"requestTimeout,omitempty"`
+	// RetryBackoff overrides the delay before the first retry of a request. Zero disables it.
+	RetryBackoff *time.Duration `yaml:"retryBackoff,omitempty"`
+}
+
+// IsSet returns whether the policy overrides any of the settings of the pool.
+func (p Policy) IsSet() bool {
+	return p.Retries != nil || p.RequestTimeout != nil || p.RetryBackoff != nil
+}
+
+// negative returns whether any of the settings of the policy is negative.
+func (p Policy) negative() bool {
+	return (p.Retries != nil && *p.Retries < 0) ||
+		(p.RequestTimeout != nil && *p.RequestTimeout < 0) ||
+		(p.RetryBackoff != nil && *p.RetryBackoff < 0)
+}
+
+// Matches returns whether path is matched by this rule.
+func (r *Rule) Matches(path string) bool {
+	if r.Suffix != "" && !strings.HasSuffix(path, r.Suffix) {
+		return false
+	}
+
+	if r.regex != nil && !r.regex.MatchString(path) {
+		return false
+	}
+
+	return true
+}
+
+func (r *Rule) compile() error {
+	if r.Suffix == "" && r.Regex == "" {
+		return fmt.Errorf("rule must define either suffix or regex")
+	}
+
+	if r.Status == 0 && r.Class == "" && r.Mirror == "" && !r.Policy.IsSet() {
+		return fmt.Errorf("rule must define an status, a class, a mirror or a retry policy")
+	}
+
+	if r.Policy.negative() {
+		return fmt.Errorf("retry policy cannot be negative")
+	}
+
+	if r.Status != 0 && r.Mirror != "" {
+		return fmt.Errorf("rule cannot define both a status and a mirror")
+	}
+
+	if r.Regex != "" {
+		var err error
+		r.regex, err = regexp.Compile(r.Regex)
+		if err != nil {
+			return fmt.Errorf("compiling regex: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// Rules is an ordered list of rules.
+type Rules []Rule
+
+// Compile validates the rules and prepares them to be matched. It must be called before Match.
+func (rs Rules) Compile() error {
+	for i := range rs {
+		err := rs[i].compile()
+		if err != nil {
+			return fmt.Errorf("rule #%d: %w", i, err)
+		}
+	}
+
+	return nil
+}
+
+// Match returns the first rule with a status matching path, or nil if none does.
+func (rs Rules) Match(path string) *Rule {
+	for i := range rs {
+		if rs[i].Status != 0 && rs[i].Matches(path) {
+			return &rs[i]
+		}
+	}
+
+	return nil
+}
+
+// Class returns the class of the first rule with a class matching path, or an empty string if none does.
+func (rs Rules) Class(path string) string {
+	for i := range rs {
+		if rs[i].Class != "" && rs[i].Matches(path) {
+			return rs[i].Class
+		}
+	}
+
+	return ""
+}
+
+// Mirror returns the mirror of the first rule with a mirror matching path, or an empty string if none does.
+func (rs Rules) Mirror(path string) string {
+	for i := range rs {
+		if rs[i].Mirror != "" && rs[i].Matches(path) {
+			return rs[i].Mirror
+		}
+	}
+
+	return ""
+}
+
+// Mirrors returns the mirrors used by any of the rules, without duplicates.
+func (rs Rules) Mirrors() []string {
+	var mirrors []string
+	seen := map[string]bool{}
+	for i := range rs {
+		if rs[i].Mirror != "" && !seen[rs[i].Mirror] {
+			seen[rs[i].Mirror] = true
+			mirrors = append(mirrors, rs[i].Mirror)
+		}
+	}
+
+	return mirrors
+}
+
+// Policy returns the retry policy of the first rule with a policy matching path, or an empty policy if none does.
+func (rs Rules) Policy(path string) Policy {
+	for i := range rs {
+		if rs[i].Policy.IsSet() && rs[i].Matches(path) {
+			return rs[i].Policy
+		}
+	}
+
+	return Policy{}
+}
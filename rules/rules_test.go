@@ -0,0 +1,243 @@
+package rules_test
+
+import (
+	"gopkg.in/yaml.v3"
+	"roob.re/refractor/rules"
+	"testing"
+	"time"
+)
+
+func TestRules_Match(t *testing.T) {
+	t.Parallel()
+
+	rs := rules.Rules{
+		{Suffix: ".db.sig", Status: 404},
+		{Regex: `^/iso/.*\.torrent$`, Status: 403, Body: "no torrents"},
+		{Suffix: ".db", Regex: `^/core/`, Status: 410},
+	}
+
+	err := rs.Compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		path   string
+		status int
+	}{
+		{path: "/core/os/x86_64/core.db.sig", status: 404},
+		{path: "/iso/latest/archlinux.iso.torrent", status: 403},
+		{path: "/core/os/x86_64/core.db", status: 410},
+		{path: "/extra/os/x86_64/extra.db"},
+		{path: "/core/os/x86_64/linux-6.0.pkg.tar.zst"},
+	} {
+		tc := tc
+		t.Run(tc.path, func(t *testing.T) {
+			t.Parallel()
+
+			rule := rs.Match(tc.path)
+			if tc.status == 0 {
+				if rule != nil {
+					t.Fatalf("expected no rule to match, got one returning %d", rule.Status)
+				}
+				return
+			}
+
+			if rule == nil {
+				t.Fatalf("expected a rule returning %d to match", tc.status)
+			}
+
+			if rule.Status != tc.status {
+				t.Fatalf("expected a rule returning %d to match, got %d", tc.status, rule.Status)
+			}
+		})
+	}
+}
+
+func TestRules_Class(t *testing.T) {
+	t.Parallel()
+
+	rs := rules.Rules{
+		{Suffix: ".db.sig", Status: 404},
+		{Suffix: ".iso", Class: "iso"},
+		{Regex: `\.pkg\.tar\.[a-z]+$`, Class: "package"},
+		{Suffix: ".pkg.tar.zst", Class: "unreachable"},
+	}
+
+	err := rs.Compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		path  string
+		class string
+	}{
+		{path: "/iso/latest/archlinux.iso", class: "iso"},
+		{path: "/core/os/x86_64/linux-6.0.pkg.tar.zst", class: "package"},
+		{path: "/core/os/x86_64/core.db.sig"},
+	} {
+		tc := tc
+		t.Run(tc.path, func(t *testing.T) {
+			t.Parallel()
+
+			if class := rs.Class(tc.path); class != tc.class {
+				t.Fatalf("expected class %q, got %q", tc.class, class)
+			}
+
+			if rule := rs.Match(tc.path); rule != nil && rule.Status == 0 {
+				t.Fatal("rules defining only a class should not answer requests")
+			}
+		})
+	}
+}
+
+func TestRules_Mirror(t *testing.T) {
+	t.Parallel()
+
+	const origin = "https://origin.example/"
+
+	rs := rules.Rules{
+		{Suffix: ".db.sig", Status: 404},
+		{Regex: `\.(db|files)$`, Mirror: origin},
+		{Suffix: ".files", Mirror: "https://unreachable.example/"},
+	}
+
+	err := rs.Compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		path   string
+		mirror string
+	}{
+		{path: "/core/os/x86_64/core.db", mirror: origin},
+		{path: "/core/os/x86_64/core.files", mirror: origin},
+		{path: "/core/os/x86_64/core.db.sig"},
+		{path: "/core/os/x86_64/linux-6.0.pkg.tar.zst"},
+	} {
+		tc := tc
+		t.Run(tc.path, func(t *testing.T) {
+			t.Parallel()
+
+			if mirror := rs.Mirror(tc.path); mirror != tc.mirror {
+				t.Fatalf("expected mirror %q, got %q", tc.mirror, mirror)
+			}
+		})
+	}
+
+	if mirrors := rs.Mirrors(); len(mirrors) != 2 {
+		t.Fatalf("expected 2 distinct mirrors, got %v", mirrors)
+	}
+}
+
+// ptr returns a pointer to v, to set policy fields.
+func ptr[T any](v T) *T {
+	return &v
+}
+
+func TestRules_Policy(t *testing.T) {
+	t.Parallel()
+
+	sigs := rules.Policy{Retries: ptr(1), RequestTimeout: ptr(10 * time.Second)}
+	isos := rules.Policy{RetryBackoff: ptr(time.Second)}
+	// Zero values are set explicitly, rather than left to the pool configuration.
+	dbs := rules.Policy{Retries: ptr(0), RequestTimeout: ptr(time.Duration(0))}
+
+	rs := rules.Rules{
+		{Suffix: ".iso", Class: "iso"},
+		{Suffix: ".sig", Policy: sigs},
+		{Suffix: ".iso", Policy: isos},
+		{Suffix: ".db", Policy: dbs},
+	}
+
+	err := rs.Compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		path   string
+		policy rules.Policy
+	}{
+		{path: "/core/os/x86_64/linux-6.0.pkg.tar.zst.sig", policy: sigs},
+		{path: "/iso/latest/archlinux.iso", policy: isos},
+		{path: "/core/os/x86_64/core.db", policy: dbs},
+		{path: "/core/os/x86_64/linux-6.0.pkg.tar.zst"},
+	} {
+		tc := tc
+		t.Run(tc.path, func(t *testing.T) {
+			t.Parallel()
+
+			if policy := rs.Policy(tc.path); policy != tc.policy {
+				t.Fatalf("expected policy %+v, got %+v", tc.policy, policy)
+			}
+		})
+	}
+}
+
+func TestRules_Policy_Decodes_Zero_Values(t *testing.T) {
+	t.Parallel()
+
+	var rs rules.Rules
+	err := yaml.Unmarshal([]byte("- suffix: .db\n  retries: 0\n  requestTimeout: 0s\n"), &rs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = rs.Compile()
+	if err != nil {
+		t.Fatalf("expected rule with zero values to be accepted, got %v", err)
+	}
+
+	policy := rs.Policy("/core/os/x86_64/core.db")
+	if policy.Retries == nil || *policy.Retries != 0 || policy.RequestTimeout == nil || *policy.RequestTimeout != 0 {
+		t.Fatalf("expected retries and requestTimeout to be set to zero, got %+v", policy)
+	}
+
+	if policy.RetryBackoff != nil {
+		t.Fatalf("expected retryBackoff to be left unset, got %v", *policy.RetryBackoff)
+	}
+}
+
+func TestRules_Profiles_Compile(t *testing.T) {
+	t.Parallel()
+
+	for name, rs := range rules.Profiles {
+		if rs == nil {
+			t.Fatalf("profile %q should not be nil, as that would not override the default rules", name)
+		}
+
+		err := rs.Compile()
+		if err != nil {
+			t.Fatalf("compiling profile %q: %v", name, err)
+		}
+	}
+}
+
+func TestRules_Compile_Rejects_Invalid(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name string
+		rule rules.Rule
+	}{
+		{name: "No_Matcher", rule: rules.Rule{Status: 404}},
+		{name: "No_Action", rule: rules.Rule{Suffix: ".sig"}},
+		{name: "Bad_Regex", rule: rules.Rule{Regex: "(", Status: 404}},
+		{name: "Status_And_Mirror", rule: rules.Rule{Suffix: ".db", Status: 404, Mirror: "https://mirror.example/"}},
+		{name: "Negative_Retries", rule: rules.Rule{Suffix: ".db", Policy: rules.Policy{Retries: ptr(-1)}}},
+		{name: "Negative_Timeout", rule: rules.Rule{Suffix: ".db", Policy: rules.Policy{RequestTimeout: ptr(-time.Second)}}},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			err := rules.Rules{tc.rule}.Compile()
+			if err == nil {
+				t.Fatal("expected rule to be rejected")
+			}
+		})
+	}
+}
@@ -0,0 +1,228 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+	"net/http"
+	"net/url"
+	"regexp"
+	"roob.re/refractor/rules"
+	"strconv"
+	"strings"
+)
+
+// debugConfig is the config shown by the /debug/config endpoint.
+type debugConfig struct {
+	Config `yaml:",inline"`
+
+	Mirrors []string `yaml:"mirrors"`
+}
+
+// debugConfig writes the effective configuration, with defaults applied, as YAML. Credentials in URLs are redacted,
+// including those in provider settings.
+func (s *Server) debugConfig(rw http.ResponseWriter, _ *http.Request) {
+	config := debugConfig{
+		Config:  s.config,
+		Mirrors: s.pool.Mirrors(),
+	}
+
+	// Provider settings are free-form, so URLs may appear anywhere in them, e.g. in the middle of a command.
+	config.Provider = make(map[string]yaml.Node, len(s.config.Provider))
+	for name, node := range s.config.Provider {
+		node := node
+		config.Provider[name] = *redactNode(&node)
+	}
+
+	config.Client.Proxy.HTTP = redactURL(config.Client.Proxy.HTTP)
+	config.Client.Proxy.HTTPS = redactURL(config.Client.Proxy.HTTPS)
+	config.Pool.Fallback = redactURL(config.Pool.Fallback)
+	config.Pool.Rules = append(rules.Rules(nil), s.pool.CurrentRules()...)
+	for i := range config.Pool.Rules {
+		config.Pool.Rules[i].Mirror = redactURL(config.Pool.Rules[i].Mirror)
+	}
+	for i, mirror := range config.Mirrors {
+		config.Mirrors[i] = redactURL(mirror)
+	}
+
+	rw.Header().Set("Content-Type", "application/yaml")
+	err := yaml.NewEncoder(rw).Encode(config)
+	if err != nil {
+		log.Errorf("Writing config to debug endpoint: %v", err)
+	}
+}
+
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return raw
+	}
+
+	return u.Redacted()
+}
+
+// passwordPattern matches URLs with a password within a string, capturing everything up to the password.
+var passwordPattern = regexp.MustCompile(`([a-zA-Z][a-zA-Z0-9+.-]*://[^:/?#@\s]*):[^/?#@\s]*@`)
+
+// redactNode returns a copy of node where the passwords of URLs found in values are redacted, as url.URL.Redacted does.
+func redactNode(node *yaml.Node) *yaml.Node {
+	redacted := *node
+	redacted.Value = passwordPattern.ReplaceAllString(node.Value, "${1}:xxxxx@")
+	redacted.Content = make([]*yaml.Node, 0, len(node.Content))
+	for _, child := range node.Content {
+		redacted.Content = append(redacted.Content, redactNode(child))
+	}
+
+	return &redacted
+}
+
+// debugDownloads writes the progress of active downloads as JSON.
+func (s *Server) debugDownloads(rw http.ResponseWriter, _ *http.Request) {
+	downloads := s.pool.Downloads()
+	for i := range downloads {
+		downloads[i].Mirror = redactURL(downloads[i].Mirror)
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(rw).Encode(downloads)
+	if err != nil {
+		log.Errorf("Writing downloads to debug endpoint: %v", err)
+	}
+}
+
+// debugRanking writes the current worker ranking as JSON.
+func (s *Server) debugRanking(rw http.ResponseWriter, _ *http.Request) {
+	ranking := s.pool.Ranking()
+	for i := range ranking {
+		// Worker names are formatted as name:url.
+		name, mirror, _ := strings.Cut(ranking[i].Worker, ":")
+		ranking[i].Worker = name + ":" + redactURL(mirror)
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(rw).Encode(ranking)
+	if err != nil {
+		log.Errorf("Writing ranking to debug endpoint: %v", err)
+	}
+}
+
+// debugStatus writes a summary of the state of the pool as JSON.
+func (s *Server) debugStatus(rw http.ResponseWriter, _ *http.Request) {
+	status := s.pool.Status()
+	for i := range status.RecentErrors {
+		status.RecentErrors[i].Mirror = redactURL(status.RecentErrors[i].Mirror)
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(rw).Encode(status)
+	if err != nil {
+		log.Errorf("Writing status to debug endpoint: %v", err)
+	}
+}
+
+// adminReset clears learned worker stats.
+func (s *Server) adminReset(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	s.pool.Reset()
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// adminDownloads handles /admin/downloads/{id}/cancel, which cancels the download with the given ID.
+func (s *Server) adminDownloads(rw http.ResponseWriter, r *http.Request) {
+	id, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/admin/downloads/"), "/")
+	if id == "" || action != "cancel" {
+		rw.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !s.pool.CancelDownload(id) {
+		rw.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// adminDrain handles /admin/drain?mirror=url, which drains the given mirror from the pool.
+func (s *Server) adminDrain(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	mirror := r.URL.Query().Get("mirror")
+	if mirror == "" {
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if !s.pool.DrainMirror(mirror) {
+		rw.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// defaultPreloadConcurrency is the amount of paths preloaded at the same time by /admin/preload, unless told otherwise.
+const defaultPreloadConcurrency = 4
+
+// adminPreload handles /admin/preload?concurrency=n, which downloads the paths listed in the body, one per line, into
+// the cache. Lines can also be URLs, of which only the path is used, and empty lines or lines starting with # are
+// ignored. It answers once every path is done, with the result for each of them as JSON.
+func (s *Server) adminPreload(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	concurrency := defaultPreloadConcurrency
+	if param := r.URL.Query().Get("concurrency"); param != "" {
+		n, err := strconv.Atoi(param)
+		if err != nil || n < 1 {
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		concurrency = n
+	}
+
+	var paths []string
+	scanner := bufio.NewScanner(r.Body)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if u, err := url.Parse(line); err == nil && u.IsAbs() {
+			line = u.Path
+		}
+		paths = append(paths, line)
+	}
+	if err := scanner.Err(); err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	results, err := s.pool.Preload(r.Context(), paths, concurrency)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(rw).Encode(results)
+	if err != nil {
+		log.Errorf("Writing preload results to admin endpoint: %v", err)
+	}
+}
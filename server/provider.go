@@ -0,0 +1,74 @@
+package server
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"roob.re/refractor/provider/providers"
+	"roob.re/refractor/provider/types"
+	"sync"
+)
+
+// newProvider builds the provider chosen in the config. It returns nil if no provider is configured.
+func (c Config) newProvider() (types.Provider, error) {
+	for pName, yamlConfig := range c.Provider {
+		pBuilder, found := providers.Map[pName]
+		if !found {
+			return nil, fmt.Errorf("unknown provider %q", pName)
+		}
+
+		pConfig := pBuilder.DefaultConfig()
+		err := yamlConfig.Decode(pConfig)
+		if err != nil {
+			return nil, fmt.Errorf("unmarshalling config for provider %q: %w", pName, err)
+		}
+
+		provider, err := pBuilder.New(pConfig)
+		if err != nil {
+			return nil, fmt.Errorf("creating provider %q: %w", pName, err)
+		}
+
+		log.Infof("Using provider %q", pName)
+		return provider, nil
+	}
+
+	return nil, nil
+}
+
+// reloadableProvider gets mirrors from a provider that can be replaced when the config is reloaded, so the pool can
+// keep feeding from it. Mirrors already in the pool are kept until they are rotated out.
+type reloadableProvider struct {
+	mtx      sync.Mutex
+	provider types.Provider
+	drainer  types.Drainer
+}
+
+func (rp *reloadableProvider) Mirror() (string, error) {
+	rp.mtx.Lock()
+	provider := rp.provider
+	rp.mtx.Unlock()
+
+	return provider.Mirror()
+}
+
+// SetDrainer passes drainer to the current provider, and to those replacing it, if they drain mirrors.
+func (rp *reloadableProvider) SetDrainer(drainer types.Drainer) {
+	rp.mtx.Lock()
+	defer rp.mtx.Unlock()
+
+	rp.drainer = drainer
+	if dp, ok := rp.provider.(types.DrainingProvider); ok {
+		dp.SetDrainer(drainer)
+	}
+}
+
+// replace makes further mirrors be taken from provider.
+func (rp *reloadableProvider) replace(provider types.Provider) {
+	rp.mtx.Lock()
+	defer rp.mtx.Unlock()
+
+	if dp, ok := provider.(types.DrainingProvider); ok && rp.drainer != nil {
+		dp.SetDrainer(rp.drainer)
+	}
+
+	rp.provider = provider
+}
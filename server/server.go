@@ -1,20 +1,56 @@
 package server
 
 import (
+	"errors"
 	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	log "github.com/sirupsen/logrus"
 	"gopkg.in/yaml.v3"
 	"io"
+	"io/fs"
+	"net"
 	"net/http"
+	"os"
+	"roob.re/refractor/cache"
 	"roob.re/refractor/client"
+	"roob.re/refractor/metrics"
+	prommetrics "roob.re/refractor/metrics/prometheus"
 	"roob.re/refractor/pool"
-	"roob.re/refractor/provider/providers"
-	"roob.re/refractor/provider/types"
+	"roob.re/refractor/rules"
 	"roob.re/refractor/stats"
+	"strings"
 	"time"
 )
 
 type Config struct {
+	// ListenAddress is the host:port refractor will listen on. Unix sockets can be specified as unix:/path/to/socket.
+	ListenAddress string `yaml:"listenAddress"`
+
+	// TLSCertFile and TLSKeyFile, if set, make refractor serve clients over HTTPS. HTTP/2 is negotiated with clients
+	// that support it.
+	TLSCertFile string `yaml:"tlsCertFile"`
+	TLSKeyFile  string `yaml:"tlsKeyFile"`
+
+	// AuditFile is the path to a file where a JSON line describing how each request was served will be appended.
+	AuditFile string `yaml:"auditFile"`
+
+	// AdminAddress, if set, is the host:port where refractor serves debug and admin endpoints, and metrics if enabled.
+	// These are not authenticated and allow controlling the pool, so they are never served on ListenAddress, and
+	// AdminAddress should not be reachable by clients. Unix sockets can be specified as unix:/path/to/socket.
+	AdminAddress string `yaml:"adminAddress"`
+
+	// Metrics enables serving Prometheus metrics on /metrics, on AdminAddress.
+	Metrics bool `yaml:"metrics"`
+
+	// Profile selects the distribution refractor serves, which determines the rules and cache rules used if none are
+	// configured. Supported profiles are archlinux, the default, debian and fedora.
+	Profile string `yaml:"profile"`
+
+	// Cache configures an on-disk cache for files downloaded from mirrors.
+	Cache cache.Config `yaml:"cache"`
+
 	Pool   pool.Config   `yaml:",inline"`
 	Client client.Config `yaml:",inline"`
 	Stats  stats.Config  `yaml:",inline"`
@@ -24,14 +60,20 @@ type Config struct {
 }
 
 const (
-	defaultPeekSizeMiBs = 1.0
-	defaultPeekTimeout  = 4 * time.Second
-	defaultRetries      = 3
+	defaultListenAddress = ":8080"
+	defaultPeekSizeMiBs  = 1.0
+	defaultPeekTimeout   = 4 * time.Second
+	defaultRetries       = 3
+	defaultWorkers       = 8
+	defaultProfile       = "archlinux"
 )
 
 type Server struct {
+	config   Config
 	pool     *pool.Pool
-	provider types.Provider
+	provider *reloadableProvider
+	// admin serves debug and admin endpoints, and metrics, on AdminAddress.
+	admin *http.ServeMux
 }
 
 func New(configFile io.Reader) (*Server, error) {
@@ -41,30 +83,26 @@ func New(configFile io.Reader) (*Server, error) {
 		return nil, fmt.Errorf("unmarshalling config: %w", err)
 	}
 
+	if config.Pool.Workers == 0 {
+		log.Infof("Defaulting Workers to %d", defaultWorkers)
+		config.Pool.Workers = defaultWorkers
+	}
+
 	// Both pool and stats share the number of workers, as a hack we use pool.Config as the source of truth.
 	config.Stats.NumWorkers = config.Pool.Workers
 
-	var provider types.Provider
-	for pName, yamlConfig := range config.Provider {
-		pBuilder, found := providers.Map[pName]
-		if !found {
-			return nil, fmt.Errorf("unknown provider %q", pName)
-		}
-
-		pConfig := pBuilder.DefaultConfig()
-		err := yamlConfig.Decode(pConfig)
-		if err != nil {
-			return nil, fmt.Errorf("unmarshalling config for provider %q: %w", pName, err)
-		}
-
-		provider, err = pBuilder.New(pConfig)
-		if err != nil {
-			return nil, fmt.Errorf("creating provider %q: %w", pName, err)
-		}
+	provider, err := config.newProvider()
+	if err != nil {
+		return nil, err
+	}
 
-		log.Infof("Using provider %q", pName)
+	if (config.TLSCertFile == "") != (config.TLSKeyFile == "") {
+		return nil, fmt.Errorf("both tlsCertFile and tlsKeyFile must be set to enable TLS")
+	}
 
-		break
+	if config.ListenAddress == "" {
+		log.Infof("Defaulting ListenAddress to %s", defaultListenAddress)
+		config.ListenAddress = defaultListenAddress
 	}
 
 	if config.Pool.PeekSizeMiBs == 0 {
@@ -77,24 +115,207 @@ func New(configFile io.Reader) (*Server, error) {
 		config.Pool.PeekTimeout = defaultPeekTimeout
 	}
 
+	err = config.compileRules()
+	if err != nil {
+		return nil, err
+	}
+
+	err = config.Pool.BandwidthLimits.Compile()
+	if err != nil {
+		return nil, fmt.Errorf("compiling bandwidth limits: %w", err)
+	}
+
+	err = config.Client.Rewrites.Compile()
+	if err != nil {
+		return nil, fmt.Errorf("compiling rewrites: %w", err)
+	}
+
+	if config.AuditFile != "" {
+		auditFile, err := os.OpenFile(config.AuditFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+		if err != nil {
+			return nil, fmt.Errorf("opening audit file: %w", err)
+		}
+
+		config.Pool.Audit = auditFile
+	}
+
+	if config.Cache.Dir != "" {
+		if config.Cache.Rules == nil {
+			config.Cache.Rules = cache.Profiles[config.Profile]
+		}
+
+		c, err := cache.New(config.Cache)
+		if err != nil {
+			return nil, fmt.Errorf("creating cache: %w", err)
+		}
+
+		log.Infof("Caching files in %s", config.Cache.Dir)
+		config.Pool.Cache = c
+	}
+
 	if config.Pool.Retries == 0 {
 		log.Infof("Defaulting Retries to %d", defaultRetries)
 		config.Pool.Retries = defaultRetries
 	}
 
-	return &Server{
-		provider: provider,
+	config.Client = config.Client.WithDefaults()
+	config.Stats = config.Stats.WithDefaults()
+
+	err = config.validate(provider)
+	if err != nil {
+		return nil, fmt.Errorf("validating config: %w", err)
+	}
+
+	admin := http.NewServeMux()
+
+	var m metrics.Metrics = metrics.Nop{}
+	if config.Metrics {
+		registry := prometheus.NewRegistry()
+		registry.MustRegister(collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+		m = prommetrics.New(registry)
+		admin.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	}
+
+	s := &Server{
+		config:   config,
+		provider: &reloadableProvider{provider: provider},
 		pool: pool.New(
 			config.Pool,
+			config.Client,
 			stats.New(config.Stats),
+			m,
 		),
-	}, nil
+		admin: admin,
+	}
+
+	s.admin.HandleFunc("/debug/config", s.debugConfig)
+	s.admin.HandleFunc("/debug/downloads", s.debugDownloads)
+	s.admin.HandleFunc("/debug/ranking", s.debugRanking)
+	s.admin.HandleFunc("/debug/status", s.debugStatus)
+	s.admin.HandleFunc("/admin/reset", s.adminReset)
+	s.admin.HandleFunc("/admin/downloads/", s.adminDownloads)
+	s.admin.HandleFunc("/admin/drain", s.adminDrain)
+	s.admin.HandleFunc("/admin/preload", s.adminPreload)
+
+	return s, nil
 }
 
+// compileRules applies the default rules for the configured profile, if no rules are configured, and compiles them.
+func (c *Config) compileRules() error {
+	if c.Profile == "" {
+		c.Profile = defaultProfile
+	}
+
+	profileRules, found := rules.Profiles[c.Profile]
+	if !found {
+		return fmt.Errorf("unknown profile %q", c.Profile)
+	}
+
+	if c.Pool.Rules == nil {
+		c.Pool.Rules = profileRules
+	}
+
+	err := c.Pool.Rules.Compile()
+	if err != nil {
+		return fmt.Errorf("compiling rules: %w", err)
+	}
+
+	return nil
+}
+
+// Reload reads the config again and applies the rules and the provider in it, without interrupting requests in
+// progress, which keep using the rules they started with. Mirrors already in the pool are kept until they are rotated
+// out. Other settings require a restart to be applied. If the new config is invalid, the current settings are kept.
+func (s *Server) Reload(configFile io.Reader) error {
+	config := Config{}
+	err := yaml.NewDecoder(configFile).Decode(&config)
+	if err != nil {
+		return fmt.Errorf("unmarshalling config: %w", err)
+	}
+
+	err = config.compileRules()
+	if err != nil {
+		return err
+	}
+
+	provider, err := config.newProvider()
+	if err != nil {
+		return err
+	}
+
+	if provider == nil {
+		return errors.New("no provider configured")
+	}
+
+	s.pool.SetRules(config.Pool.Rules)
+	s.provider.replace(provider)
+	log.Infof("Reloaded rules and provider, other settings will be applied when refractor restarts")
+
+	return nil
+}
+
+// Run starts the pool and serves requests, and admin endpoints if AdminAddress is set. If address is empty, the
+// ListenAddress from the config is used. It returns as soon as either of them stops being served.
 func (s *Server) Run(address string) error {
+	if address == "" {
+		address = s.config.ListenAddress
+	}
+
+	listener, err := listen(address)
+	if err != nil {
+		return fmt.Errorf("listening on %s: %w", address, err)
+	}
+
+	errs := make(chan error, 2)
+	if s.config.AdminAddress != "" {
+		adminListener, err := listen(s.config.AdminAddress)
+		if err != nil {
+			_ = listener.Close()
+			return fmt.Errorf("listening on %s: %w", s.config.AdminAddress, err)
+		}
+
+		log.Infof("Serving admin endpoints on %s", s.config.AdminAddress)
+		go func() {
+			errs <- fmt.Errorf("serving admin endpoints: %w", http.Serve(adminListener, s.admin))
+		}()
+	}
+
 	go s.pool.Run()
 	go s.pool.Feed(s.provider)
 
-	log.Infof("Listening on %s", address)
-	return http.ListenAndServe(address, s.pool)
+	go func() {
+		if s.config.TLSCertFile != "" {
+			log.Infof("Listening on %s with TLS", address)
+			errs <- http.ServeTLS(listener, s, s.config.TLSCertFile, s.config.TLSKeyFile)
+			return
+		}
+
+		log.Infof("Listening on %s", address)
+		errs <- http.Serve(listener, s)
+	}()
+
+	return <-errs
+}
+
+func listen(address string) (net.Listener, error) {
+	path := strings.TrimPrefix(address, "unix:")
+	if path == address {
+		return net.Listen("tcp", address)
+	}
+
+	// Sockets are not removed when the process is killed, so remove them if they are left over from a previous run.
+	if info, err := os.Stat(path); err == nil && info.Mode()&fs.ModeSocket != 0 {
+		err = os.Remove(path)
+		if err != nil {
+			return nil, fmt.Errorf("removing stale socket: %w", err)
+		}
+	}
+
+	return net.Listen("unix", path)
+}
+
+// ServeHTTP serves requests from clients. Debug and admin endpoints are not served here, but on AdminAddress, so any
+// path is forwarded to mirrors.
+func (s *Server) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	s.pool.ServeHTTP(rw, r)
 }
@@ -0,0 +1,250 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"roob.re/refractor/pool"
+	"roob.re/refractor/pool/pooltest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestServer creates a server from config, fed with mirror by a command provider, and starts its pool.
+func newTestServer(t *testing.T, config string, mirror *pooltest.Mirror) *Server {
+	t.Helper()
+
+	config += fmt.Sprintf("\nprovider:\n  command:\n    command: echo %s\n", mirror.URL())
+	s, err := New(strings.NewReader(config))
+	if err != nil {
+		t.Fatalf("creating server: %v", err)
+	}
+
+	go s.pool.Run()
+	go s.pool.Feed(s.provider)
+
+	return s
+}
+
+func TestServer_Serves_Admin_Endpoints_On_Admin_Address_Only(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		method string
+		path   string
+		status int
+	}{
+		{method: http.MethodGet, path: "/debug/config", status: http.StatusOK},
+		{method: http.MethodGet, path: "/debug/downloads", status: http.StatusOK},
+		{method: http.MethodGet, path: "/debug/ranking", status: http.StatusOK},
+		{method: http.MethodGet, path: "/debug/status", status: http.StatusOK},
+		{method: http.MethodGet, path: "/metrics", status: http.StatusOK},
+		{method: http.MethodPost, path: "/admin/reset", status: http.StatusNoContent},
+		{method: http.MethodPost, path: "/admin/downloads/unknown/cancel", status: http.StatusNotFound},
+		{method: http.MethodPost, path: "/admin/drain?mirror=https://unknown.example/", status: http.StatusNotFound},
+		{method: http.MethodPost, path: "/admin/preload", status: http.StatusNotFound},
+	} {
+		tc := tc
+		t.Run(tc.method+" "+tc.path, func(t *testing.T) {
+			t.Parallel()
+
+			mirror := pooltest.NewMirror(nil)
+			t.Cleanup(mirror.Close)
+
+			s := newTestServer(t, "adminAddress: localhost:0\nmetrics: true\n", mirror)
+
+			rec := httptest.NewRecorder()
+			s.admin.ServeHTTP(rec, httptest.NewRequest(tc.method, tc.path, nil))
+			if rec.Code != tc.status {
+				t.Fatalf("expected admin endpoint to answer %d, got %d", tc.status, rec.Code)
+			}
+
+			if mirror.Requests() != 0 {
+				t.Fatalf("admin endpoint was forwarded to the mirror")
+			}
+
+			rec = httptest.NewRecorder()
+			s.ServeHTTP(rec, httptest.NewRequest(tc.method, tc.path, nil))
+			if mirror.Requests() == 0 {
+				t.Fatalf("expected %s to be forwarded to the mirror by the client listener", tc.path)
+			}
+		})
+	}
+}
+
+func TestServer_Resets_Ranking(t *testing.T) {
+	t.Parallel()
+
+	mirror := pooltest.NewMirror(map[string][]byte{"/file": bytes.Repeat([]byte("refractor"), 1024)})
+	t.Cleanup(mirror.Close)
+	// Downloads taking too little time are not sampled.
+	mirror.SetBehavior(pooltest.Behavior{Latency: 100 * time.Millisecond})
+
+	s := newTestServer(t, "adminAddress: localhost:0\n", mirror)
+
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/file", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", rec.Code)
+	}
+
+	// Samples are recorded asynchronously.
+	deadline := time.Now().Add(time.Second)
+	for len(s.pool.Ranking()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("download was not sampled")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	rec = httptest.NewRecorder()
+	s.admin.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/admin/reset", nil))
+	if rec.Code != http.StatusMethodNotAllowed || len(s.pool.Ranking()) == 0 {
+		t.Fatalf("expected GET to be rejected and leave the ranking alone, got status %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	s.admin.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/admin/reset", nil))
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("expected status 204, got %d", rec.Code)
+	}
+
+	if ranking := s.pool.Ranking(); len(ranking) != 0 {
+		t.Fatalf("expected ranking to be cleared, got %+v", ranking)
+	}
+}
+
+func TestServer_Cancels_Download(t *testing.T) {
+	t.Parallel()
+
+	mirror := pooltest.NewMirror(map[string][]byte{"/file": bytes.Repeat([]byte("refractor"), 1024)})
+	t.Cleanup(mirror.Close)
+	mirror.SetBehavior(pooltest.Behavior{Stall: 10 * time.Second})
+
+	s := newTestServer(t, "adminAddress: localhost:0\npeekTimeout: 10s\n", mirror)
+
+	done := make(chan int)
+	go func() {
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/file", nil))
+		done <- rec.Code
+	}()
+
+	deadline := time.Now().Add(time.Second)
+	for len(s.pool.Downloads()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("download did not start")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cancel := httptest.NewRequest(http.MethodPost, "/admin/downloads/"+s.pool.Downloads()[0].ID+"/cancel", nil)
+
+	// Clients must not be able to cancel downloads of others.
+	s.ServeHTTP(httptest.NewRecorder(), cancel)
+	if len(s.pool.Downloads()) == 0 {
+		t.Fatalf("download was canceled through the client listener")
+	}
+
+	rec := httptest.NewRecorder()
+	s.admin.ServeHTTP(rec, cancel)
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("expected status 204, got %d", rec.Code)
+	}
+
+	select {
+	case status := <-done:
+		if status != http.StatusServiceUnavailable {
+			t.Fatalf("expected canceled download to be answered with 503, got %d", status)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("download was not canceled")
+	}
+}
+
+func TestServer_Preloads_Cache(t *testing.T) {
+	t.Parallel()
+
+	const pkgPath = "/core/os/x86_64/linux-6.0.pkg.tar.zst"
+
+	mirror := pooltest.NewMirror(map[string][]byte{pkgPath: bytes.Repeat([]byte("refractor"), 1024)})
+	t.Cleanup(mirror.Close)
+
+	s := newTestServer(t, fmt.Sprintf("adminAddress: localhost:0\ncache:\n  dir: %s\n  maxSizeMiBs: 1\n", t.TempDir()), mirror)
+
+	list := "# Hot packages\n" + mirror.URL() + pkgPath + "\n\n"
+
+	rec := httptest.NewRecorder()
+	s.admin.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/admin/preload?concurrency=0", strings.NewReader(list)))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected invalid concurrency to be rejected, got status %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	s.admin.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/admin/preload?concurrency=2", strings.NewReader(list)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", rec.Code)
+	}
+
+	var results []pool.PreloadResult
+	err := json.NewDecoder(rec.Body).Decode(&results)
+	if err != nil {
+		t.Fatalf("decoding results: %v", err)
+	}
+
+	if len(results) != 1 || results[0] != (pool.PreloadResult{Path: pkgPath, Status: http.StatusOK}) {
+		t.Fatalf("expected package to be preloaded, got %+v", results)
+	}
+
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, pkgPath, nil))
+	if rec.Code != http.StatusOK || mirror.Requests() != 1 {
+		t.Fatalf("expected preloaded package to be served from cache, got status %d and %d requests to the mirror",
+			rec.Code, mirror.Requests())
+	}
+}
+
+func TestServer_Reloads_Rules_And_Provider(t *testing.T) {
+	t.Parallel()
+
+	const pkgPath = "/core/os/x86_64/linux-6.0.pkg.tar.zst"
+
+	old := pooltest.NewMirror(map[string][]byte{pkgPath: []byte("refractor")})
+	t.Cleanup(old.Close)
+
+	replacement := pooltest.NewMirror(map[string][]byte{pkgPath: []byte("refractor")})
+	t.Cleanup(replacement.Close)
+
+	s := newTestServer(t, "workers: 1\nretries: 5\n", old)
+
+	err := s.Reload(strings.NewReader("provider:\n  unknown: {}\n"))
+	if err == nil {
+		t.Fatal("expected config with an unknown provider to be rejected")
+	}
+
+	err = s.Reload(strings.NewReader(fmt.Sprintf(
+		"rules:\n- suffix: .sig\n  status: 410\nprovider:\n  command:\n    command: echo %s\n", replacement.URL(),
+	)))
+	if err != nil {
+		t.Fatalf("reloading config: %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, pkgPath+".sig", nil))
+	if rec.Code != http.StatusGone {
+		t.Fatalf("expected reloaded rule to answer with status 410, got %d", rec.Code)
+	}
+
+	// Once the old mirror goes away, the pool is fed with mirrors from the new provider.
+	old.Close()
+	for i := 0; i < 5 && replacement.Requests() == 0; i++ {
+		s.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, pkgPath, nil))
+	}
+
+	if replacement.Requests() == 0 {
+		t.Fatal("expected mirror from the reloaded provider to be used")
+	}
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"roob.re/refractor/provider/types"
+)
+
+// validate checks the config, once defaults have been applied, for values that would prevent refractor from serving
+// requests. Values that are valid but likely not what the user intended are logged as warnings.
+func (c Config) validate(provider types.Provider) error {
+	if provider == nil {
+		return errors.New("no provider configured")
+	}
+
+	if c.Pool.Workers <= 0 {
+		return fmt.Errorf("workers must be positive, got %d", c.Pool.Workers)
+	}
+
+	if c.Pool.Retries < 0 {
+		return fmt.Errorf("retries must not be negative, got %d", c.Pool.Retries)
+	}
+
+	if c.Pool.PeekSizeMiBs < 0 {
+		return fmt.Errorf("peekSizeMiBs must not be negative, got %d", c.Pool.PeekSizeMiBs)
+	}
+
+	if c.Pool.PeekTimeout < 0 {
+		return fmt.Errorf("peekTimeout must not be negative, got %v", c.Pool.PeekTimeout)
+	}
+
+	if c.Pool.RequestTimeout < 0 {
+		return fmt.Errorf("requestTimeout must not be negative, got %v", c.Pool.RequestTimeout)
+	}
+
+	if c.Pool.RetryBackoff < 0 {
+		return fmt.Errorf("retryBackoff must not be negative, got %v", c.Pool.RetryBackoff)
+	}
+
+	if c.Pool.MaxMiBs < 0 || c.Pool.ClientMiBs < 0 {
+		return fmt.Errorf("maxMiBs and clientMiBs must not be negative")
+	}
+
+	// Mirrors could never reach the minimum throughput if downloads are capped below it.
+	if c.Pool.MaxMiBs > 0 && c.Pool.MinThroughputMiBs >= c.Pool.MaxMiBs {
+		return fmt.Errorf("minThroughputMiBs (%v) must be lower than maxMiBs (%v)", c.Pool.MinThroughputMiBs, c.Pool.MaxMiBs)
+	}
+
+	if c.Pool.ClientMiBs > 0 && c.Pool.MinThroughputMiBs >= c.Pool.ClientMiBs {
+		return fmt.Errorf("minThroughputMiBs (%v) must be lower than clientMiBs (%v)", c.Pool.MinThroughputMiBs, c.Pool.ClientMiBs)
+	}
+
+	if c.Pool.EgressCapGiBs < 0 {
+		return fmt.Errorf("egressCapGiBs must not be negative, got %v", c.Pool.EgressCapGiBs)
+	}
+
+	if c.Pool.CacheBufferMiBs < 0 {
+		return fmt.Errorf("cacheBufferMiBs must not be negative, got %v", c.Pool.CacheBufferMiBs)
+	}
+
+	if c.Stats.NumTopWorkers < 0 {
+		return fmt.Errorf("topWorkers must not be negative, got %d", c.Stats.NumTopWorkers)
+	}
+
+	if c.AdminAddress != "" && c.AdminAddress == c.ListenAddress {
+		return fmt.Errorf("adminAddress must be different from listenAddress, as admin endpoints must not be served to clients")
+	}
+
+	if c.Stats.NumTopWorkers >= c.Pool.Workers {
+		log.Warnf("topWorkers (%d) is not lower than workers (%d), so slow mirrors will never be rotated out of the pool",
+			c.Stats.NumTopWorkers, c.Pool.Workers)
+	}
+
+	if c.Pool.RequestTimeout != 0 && c.Pool.RequestTimeout <= c.Pool.PeekTimeout {
+		log.Warnf("requestTimeout (%v) is not longer than peekTimeout (%v), so slow requests will time out before being retried",
+			c.Pool.RequestTimeout, c.Pool.PeekTimeout)
+	}
+
+	if c.Pool.RequestTimeout != 0 && c.Pool.RequestTimeout <= c.Client.PreDownloadTimeout {
+		log.Warnf("requestTimeout (%v) is not longer than preDownloadTimeout (%v), so unresponsive mirrors will not be retried",
+			c.Pool.RequestTimeout, c.Client.PreDownloadTimeout)
+	}
+
+	if c.Metrics && c.AdminAddress == "" {
+		log.Warnf("metrics is enabled but adminAddress is not set, so metrics will not be served")
+	}
+
+	return nil
+}
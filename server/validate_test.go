@@ -0,0 +1,155 @@
+package server
+
+import (
+	log "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"roob.re/refractor/client"
+	"roob.re/refractor/pool"
+	"roob.re/refractor/provider/types"
+	"roob.re/refractor/stats"
+	"strings"
+	"testing"
+	"time"
+)
+
+type provider struct{}
+
+func (provider) Mirror() (string, error) {
+	return "https://mirror.example/", nil
+}
+
+// validConfig returns a config that passes validation without warnings.
+func validConfig() Config {
+	return Config{
+		Pool: pool.Config{
+			Workers:        4,
+			Retries:        2,
+			PeekSizeMiBs:   1,
+			PeekTimeout:    5 * time.Second,
+			RequestTimeout: time.Minute,
+		},
+		Client: client.Config{PreDownloadTimeout: 10 * time.Second},
+		Stats:  stats.Config{NumTopWorkers: 2},
+	}
+}
+
+func TestConfig_Validate_Rejects(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name       string
+		modify     func(c *Config)
+		noProvider bool
+		error      string
+	}{
+		{name: "no provider", modify: func(c *Config) {}, noProvider: true, error: "no provider"},
+		{name: "negative workers", modify: func(c *Config) { c.Pool.Workers = -1 }, error: "workers"},
+		{name: "zero workers", modify: func(c *Config) { c.Pool.Workers = 0 }, error: "workers"},
+		{name: "negative retries", modify: func(c *Config) { c.Pool.Retries = -1 }, error: "retries"},
+		{name: "negative peek size", modify: func(c *Config) { c.Pool.PeekSizeMiBs = -1 }, error: "peekSizeMiBs"},
+		{name: "negative peek timeout", modify: func(c *Config) { c.Pool.PeekTimeout = -time.Second }, error: "peekTimeout"},
+		{name: "negative request timeout", modify: func(c *Config) { c.Pool.RequestTimeout = -time.Second }, error: "requestTimeout"},
+		{name: "negative backoff", modify: func(c *Config) { c.Pool.RetryBackoff = -time.Second }, error: "retryBackoff"},
+		{name: "negative max bandwidth", modify: func(c *Config) { c.Pool.MaxMiBs = -1 }, error: "maxMiBs"},
+		{name: "negative client bandwidth", modify: func(c *Config) { c.Pool.ClientMiBs = -1 }, error: "clientMiBs"},
+		{
+			name:   "min throughput over max bandwidth",
+			modify: func(c *Config) { c.Pool.MaxMiBs, c.Pool.MinThroughputMiBs = 10, 10 },
+			error:  "maxMiBs",
+		},
+		{
+			name:   "min throughput over client bandwidth",
+			modify: func(c *Config) { c.Pool.ClientMiBs, c.Pool.MinThroughputMiBs = 5, 8 },
+			error:  "clientMiBs",
+		},
+		{name: "negative egress cap", modify: func(c *Config) { c.Pool.EgressCapGiBs = -1 }, error: "egressCapGiBs"},
+		{name: "negative cache buffer", modify: func(c *Config) { c.Pool.CacheBufferMiBs = -1 }, error: "cacheBufferMiBs"},
+		{name: "negative top workers", modify: func(c *Config) { c.Stats.NumTopWorkers = -1 }, error: "topWorkers"},
+		{
+			name:   "admin address same as listen address",
+			modify: func(c *Config) { c.ListenAddress, c.AdminAddress = ":8080", ":8080" },
+			error:  "adminAddress",
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			c := validConfig()
+			tc.modify(&c)
+
+			var p types.Provider = provider{}
+			if tc.noProvider {
+				p = nil
+			}
+
+			err := c.validate(p)
+			if err == nil {
+				t.Fatalf("expected config to be rejected")
+			}
+
+			if !strings.Contains(err.Error(), tc.error) {
+				t.Fatalf("expected error to mention %q, got %v", tc.error, err)
+			}
+		})
+	}
+}
+
+// TestConfig_Validate_Warns is not parallel, as it captures the output of the global logger.
+func TestConfig_Validate_Warns(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		modify  func(c *Config)
+		warning string
+	}{
+		{name: "valid", modify: func(c *Config) {}},
+		{
+			name:   "bandwidth over min throughput",
+			modify: func(c *Config) { c.Pool.MaxMiBs, c.Pool.ClientMiBs, c.Pool.MinThroughputMiBs = 10, 5, 1 },
+		},
+		{name: "metrics on admin address", modify: func(c *Config) { c.Metrics, c.AdminAddress = true, ":8081" }},
+		{name: "top workers", modify: func(c *Config) { c.Stats.NumTopWorkers = 4 }, warning: "topWorkers"},
+		{name: "metrics without admin address", modify: func(c *Config) { c.Metrics = true }, warning: "adminAddress"},
+		{
+			name:    "request timeout under peek timeout",
+			modify:  func(c *Config) { c.Pool.PeekTimeout, c.Pool.RequestTimeout = 20*time.Second, 15*time.Second },
+			warning: "peekTimeout",
+		},
+		{
+			name:    "request timeout under pre download timeout",
+			modify:  func(c *Config) { c.Pool.RequestTimeout = 8 * time.Second },
+			warning: "preDownloadTimeout",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			hook := test.NewGlobal()
+			t.Cleanup(hook.Reset)
+
+			c := validConfig()
+			tc.modify(&c)
+
+			err := c.validate(provider{})
+			if err != nil {
+				t.Fatalf("expected config to be accepted, got %v", err)
+			}
+
+			var warnings []string
+			for _, entry := range hook.AllEntries() {
+				if entry.Level == log.WarnLevel {
+					warnings = append(warnings, entry.Message)
+				}
+			}
+
+			if tc.warning == "" {
+				if len(warnings) != 0 {
+					t.Fatalf("expected no warnings, got %v", warnings)
+				}
+				return
+			}
+
+			if len(warnings) != 1 || !strings.Contains(warnings[0], tc.warning) {
+				t.Fatalf("expected a warning about %s, got %v", tc.warning, warnings)
+			}
+		})
+	}
+}
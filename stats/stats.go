@@ -62,11 +62,29 @@ func (s Sample) Throughput() float64 {
 type workerEntry struct {
 	samples int
 	average float64
+	evicted bool
 }
 
 type namedEntry struct {
 	name       string
 	throughput float64
+	samples    int
+	evicted    bool
+}
+
+// Rank describes the position of a worker in the ranking.
+type Rank struct {
+	Worker         string  `json:"worker"`
+	ThroughputMiBs float64 `json:"throughputMiBs"`
+	Samples        int     `json:"samples"`
+	// Top is true for workers ranked within the top workers. These are kept in the pool unless they are marked to be
+	// evicted, as are workers ranked below them whose throughput is over GoodThroughputMiBs.
+	Top bool `json:"top"`
+	// Evicted is true if the worker has been marked to be evicted on its next request.
+	Evicted bool `json:"evicted"`
+	// Downloads is the amount of downloads in progress from the mirror of the worker. It is not known to Stats, and
+	// is filled in by pool.Pool.
+	Downloads int `json:"downloads"`
 }
 
 func New(c Config) *Stats {
@@ -76,6 +94,14 @@ func New(c Config) *Stats {
 	}
 }
 
+// Reset forgets all samples and evictions recorded so far.
+func (s *Stats) Reset() {
+	s.Lock()
+	defer s.Unlock()
+
+	s.workers = map[string]workerEntry{}
+}
+
 func (s *Stats) Remove(name string) {
 	s.Lock()
 	defer s.Unlock()
@@ -83,6 +109,16 @@ func (s *Stats) Remove(name string) {
 	delete(s.workers, name)
 }
 
+// Evict marks a worker as a bad performer regardless of its throughput, so it is evicted on its next request.
+func (s *Stats) Evict(name string) {
+	s.Lock()
+	defer s.Unlock()
+
+	w := s.workers[name]
+	w.evicted = true
+	s.workers[name] = w
+}
+
 func (s *Stats) Update(name string, sample Sample) {
 	if sample.Bytes < minSampleBytes && sample.Duration < minDurationForMinBytes {
 		log.Infof("Dropping sample for %s, not enough bytes to measure (%d)", name, sample.Bytes)
@@ -117,6 +153,11 @@ func (s *Stats) Update(name string, sample Sample) {
 }
 
 func (s *Stats) GoodPerformer(name string) bool {
+	if s.evicted(name) {
+		log.Debugf("Worker %s has been marked for eviction", name)
+		return false
+	}
+
 	entries := s.workerList()
 
 	if len(entries) <= s.NumTopWorkers {
@@ -144,6 +185,30 @@ func (s *Stats) GoodPerformer(name string) bool {
 	return position < s.NumTopWorkers
 }
 
+func (s *Stats) evicted(name string) bool {
+	s.RLock()
+	defer s.RUnlock()
+
+	return s.workers[name].evicted
+}
+
+// Ranking returns the ranked workers, from best to worst throughput. Workers without samples are not ranked.
+func (s *Stats) Ranking() []Rank {
+	entries := s.workerList()
+	ranking := make([]Rank, 0, len(entries))
+	for i, entry := range entries {
+		ranking = append(ranking, Rank{
+			Worker:         entry.name,
+			ThroughputMiBs: entry.throughput / 1024 / 1024,
+			Samples:        entry.samples,
+			Top:            i < s.NumTopWorkers,
+			Evicted:        entry.evicted,
+		})
+	}
+
+	return ranking
+}
+
 func (s *Stats) report() {
 	if !s.shouldReport() {
 		return
@@ -183,6 +248,8 @@ func (s *Stats) workerList() []namedEntry {
 		entries = append(entries, namedEntry{
 			name:       wName,
 			throughput: entry.average,
+			samples:    entry.samples,
+			evicted:    entry.evicted,
 		})
 	}
 
@@ -0,0 +1,59 @@
+package stats
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStats_Ranking(t *testing.T) {
+	t.Parallel()
+
+	s := New(Config{NumWorkers: 4, NumTopWorkers: 1, GoodThroughputMiBs: 5})
+
+	// mibs returns a sample with a throughput of m MiB/s.
+	mibs := func(m float64) Sample {
+		return Sample{Bytes: int64(m * 1024 * 1024), Duration: time.Second}
+	}
+
+	s.Update("slow", mibs(1))
+	s.Update("fast", mibs(8))
+	s.Update("fast", mibs(12))
+	s.Update("good", mibs(6))
+	s.Update("evicted", mibs(7))
+	s.Update("dropped", Sample{Bytes: 10, Duration: time.Millisecond})
+	s.Evict("evicted")
+
+	ranking := s.Ranking()
+	expected := []Rank{
+		{Worker: "fast", ThroughputMiBs: 10, Samples: 2, Top: true},
+		{Worker: "evicted", ThroughputMiBs: 7, Samples: 1, Evicted: true},
+		{Worker: "good", ThroughputMiBs: 6, Samples: 1},
+		{Worker: "slow", ThroughputMiBs: 1, Samples: 1},
+	}
+
+	if len(ranking) != len(expected) {
+		t.Fatalf("expected %d ranked workers, got %+v", len(expected), ranking)
+	}
+
+	for i := range expected {
+		if ranking[i] != expected[i] {
+			t.Fatalf("expected position %d to be %+v, got %+v", i, expected[i], ranking[i])
+		}
+	}
+
+	// Workers outside the top are kept if their throughput is good, while evicted ones are not.
+	for _, tc := range []struct {
+		worker string
+		good   bool
+	}{
+		{worker: "fast", good: true},
+		{worker: "evicted", good: false},
+		{worker: "good", good: true},
+		{worker: "slow", good: false},
+		{worker: "unranked", good: true},
+	} {
+		if good := s.GoodPerformer(tc.worker); good != tc.good {
+			t.Fatalf("expected GoodPerformer(%s) to be %v", tc.worker, tc.good)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package worker
 
 import (
+	"errors"
 	"fmt"
 	log "github.com/sirupsen/logrus"
 	"roob.re/refractor/client"
@@ -8,6 +9,14 @@ import (
 	"time"
 )
 
+// ErrPoorPerformer is returned by Work when the worker stops because its mirror is not performing well enough
+// compared to others, or it was explicitly marked for eviction.
+var ErrPoorPerformer = errors.New("not a good performer")
+
+// handoffTimeout is how long a worker excluded from a request waits for a different one to take it, before serving it
+// anyway.
+const handoffTimeout = 2 * time.Second
+
 type Worker struct {
 	Name   string
 	Stats  *stats.Stats
@@ -27,29 +36,38 @@ func (w Worker) Work(requests chan client.Request) error {
 				requests <- req
 			}()
 
-			return fmt.Errorf("worker %s is not a good performer, evicting and requeuing request", w.String())
+			return fmt.Errorf("worker %s is %w, evicting and requeuing request", w.String(), ErrPoorPerformer)
+		}
+
+		if req.Excludes(w.String()) && w.handoff(requests, req) {
+			continue
 		}
 
-		log.Infof("Requesting %s:%s", w.Name, w.Client.URL(req.Path))
+		log.WithField("download", req.ID).Infof("Requesting %s:%s", w.Name, w.Client.URL(req.Path))
 
 		start := time.Now()
 		response := w.Client.Do(req)
 		response.Worker = w.String()
 
 		if response.Error != nil {
-			go func() {
-				requests <- req
-			}()
+			// The error is sent back so the attempt counts towards the retries of the request, instead of looping
+			// forever if mirrors cannot be reached at all.
+			req.ResponseChan <- response
+
+			// The mirror is not at fault if the request ran out of time.
+			if req.Expired() {
+				continue
+			}
 
-			return fmt.Errorf("worker %s returned error for %s, sacrificing: %v", w.String(), req.Path, response.Error)
+			return fmt.Errorf("worker %s returned error for %s, sacrificing: %w", w.String(), req.Path, response.Error)
 		}
 
-		response.Done = func(written int64) {
+		response.Done = func(written int64, throttled time.Duration) {
 			sample := stats.Sample{
 				Bytes:    written,
-				Duration: time.Since(start),
+				Duration: time.Since(start) - throttled,
 			}
-			log.Infof("%s %s:%s", sample.String(), w.Name, w.Client.URL(req.Path))
+			log.WithField("download", req.ID).Infof("%s %s:%s", sample.String(), w.Name, w.Client.URL(req.Path))
 			go w.Stats.Update(w.String(), sample)
 		}
 
@@ -58,3 +76,26 @@ func (w Worker) Work(requests chan client.Request) error {
 
 	return fmt.Errorf("request channel closed")
 }
+
+// handoff tries to leave req to a different worker, and returns whether one took it. As a worker cannot receive a
+// request while it is sending it, the request is never taken by the same worker.
+func (w Worker) handoff(requests chan client.Request, req client.Request) bool {
+	var done <-chan struct{}
+	if req.Context != nil {
+		done = req.Context.Done()
+	}
+
+	timer := time.NewTimer(handoffTimeout)
+	defer timer.Stop()
+
+	req.Handoffs++
+	select {
+	case requests <- req:
+		log.WithField("download", req.ID).Debugf("Worker %s handed off %s, which it already failed to serve", w.String(), req.Path)
+		return true
+	case <-timer.C:
+	case <-done:
+	}
+
+	return false
+}